@@ -0,0 +1,101 @@
+package ballotbox
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agoravoting/agora-http-go/middleware"
+	s "github.com/agoravoting/agora-http-go/server"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Admin routes declare one of these permissions:
+//
+//   - global-admin: server wide operations, and any election
+//   - admin-<election-id>-write: changes to an election
+//   - admin-<election-id>-read: reading the admin data of an election, also
+//     allowed by the write permission
+//
+// Admin tokens are HMAC headers signed with the server SharedSecret that
+// name the admin, <perm>:<timestamp>:<principal>:<hmac>, see AdminAuthHeader.
+// The principal must be in the server Admins list, if it is not empty. The
+// legacy admin:<timestamp>:<hmac> tokens, without principal, still grant
+// global-admin. Every admin call is logged with its principal and outcome
+const (
+	PermGlobalAdmin = "global-admin"
+	// without principal
+	permLegacyAdmin = "admin"
+)
+
+// adminGrants returns whether a token with perm allows the required
+// permission of a route
+func adminGrants(perm string, required string) bool {
+	switch perm {
+	case required, PermGlobalAdmin, permLegacyAdmin:
+		return true
+	}
+	// write allows read
+	return strings.HasSuffix(required, "-read") && perm == strings.TrimSuffix(required, "-read")+"-write"
+}
+
+// isAdmin returns whether principal is in the server Admins list, any
+// principal is accepted if it is empty
+func isAdmin(principal string) bool {
+	if len(s.Server.Admins) == 0 {
+		return true
+	}
+	for _, admin := range s.Server.Admins {
+		if admin == principal {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminAuthHeader returns an admin token granting perm to principal
+func AdminAuthHeader(perm string, principal string, secret string) string {
+	message := fmt.Sprintf("%s:%d:%s", perm, time.Now().Unix(), principal)
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(message))
+	return fmt.Sprintf("%s:%x", message, h.Sum(nil))
+}
+
+// adminAuth wraps the handler of an admin route with the check of the admin
+// token against the route perm, and logs the call
+func (bb *BallotBox) adminAuth(perm string, handler middleware.ErrorHandler) middleware.ErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+		required := expandPerm(perm, p)
+		principal := "-"
+		hErr := func() *middleware.HandledError {
+			message := verifyAuthHeader(r.Header.Get("Authorization"), []string{s.Server.SharedSecret}, bb.sessionExpire, bb.clock())
+			if message == nil {
+				return &middleware.HandledError{Code: 403, Message: "Invalid or expired admin token", CodedMessage: "invalid-auth"}
+			}
+			if message.Extra == "" && message.Perm != permLegacyAdmin {
+				return &middleware.HandledError{Code: 403, Message: "Admin token without principal", CodedMessage: "invalid-auth"}
+			}
+			if message.Extra != "" {
+				principal = message.Extra
+				if !isAdmin(principal) {
+					return &middleware.HandledError{Code: 403, Message: "Unknown admin", CodedMessage: "unknown-admin"}
+				}
+			}
+			if !adminGrants(message.Perm, required) {
+				return &middleware.HandledError{Code: 403, Message: "Permission " + required + " required", CodedMessage: "permission-denied"}
+			}
+			return handler(w, r, p)
+		}()
+
+		outcome := "ok"
+		if hErr != nil {
+			outcome = strconv.Itoa(hErr.Code) + " " + hErr.CodedMessage
+		}
+		s.Server.Logger.Printf("Admin call %s %s by %s with %s: %s", r.Method, r.URL.Path, principal, required, outcome)
+		return hErr
+	}
+}
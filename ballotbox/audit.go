@@ -0,0 +1,163 @@
+package ballotbox
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/agoravoting/agora-http-go/middleware"
+	s "github.com/agoravoting/agora-http-go/server"
+	"github.com/julienschmidt/httprouter"
+)
+
+// number of checked ballots between progress reports
+const auditProgressInterval = 1000
+
+// InvalidBallot is a stored ballot that fails validation
+type InvalidBallot struct {
+	Id       int64  `json:"id"`
+	VoterId  string `json:"voter_id"`
+	VoteHash string `json:"vote_hash"`
+	Reason   string `json:"reason"`
+}
+
+// AuditReport is the result of re-validating the stored ballots of an
+// election against its current pubkeys
+type AuditReport struct {
+	ElectionId string           `json:"election_id"`
+	Checked    int64            `json:"checked"`
+	Invalid    []*InvalidBallot `json:"invalid"`
+	// why the pubkeys fail verification, the ballots are then checked
+	// against them as decoded
+	PkErrors []string `json:"pk_errors,omitempty"`
+}
+
+// auditVotes validates the votes read from the channel with the given number
+// of workers, progress is called every auditProgressInterval ballots with
+// the number of ballots checked so far
+func auditVotes(electionId string, votes <-chan *Vote, pks []map[string]*big.Int, checkResidues bool, eCfg *electionCfg, workers int, progress func(checked int64)) *AuditReport {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	report := &AuditReport{ElectionId: electionId, Invalid: []*InvalidBallot{}}
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for v := range votes {
+				voteHash := v.VoteHash
+				if err := validateStored(v, pks, checkResidues, eCfg); err != nil {
+					mutex.Lock()
+					report.Invalid = append(report.Invalid, &InvalidBallot{Id: v.Id, VoterId: v.VoterId, VoteHash: voteHash, Reason: err.Error()})
+					mutex.Unlock()
+				}
+				if checked := atomic.AddInt64(&report.Checked, 1); progress != nil && checked%auditProgressInterval == 0 {
+					progress(checked)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Sort(invalidBallotsById(report.Invalid))
+	return report
+}
+
+// validateStored validates a stored vote, reporting a panic as an error so
+// that one malformed ballot doesn't stop the audit
+func validateStored(v *Vote, pks []map[string]*big.Int, checkResidues bool, eCfg *electionCfg) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Validation panic: %v", r)
+		}
+	}()
+	return v.validate(pks, checkResidues, eCfg, nil)
+}
+
+type invalidBallotsById []*InvalidBallot
+
+func (b invalidBallotsById) Len() int           { return len(b) }
+func (b invalidBallotsById) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b invalidBallotsById) Less(i, j int) bool { return b[i].Id < b[j].Id }
+
+// auditElection streams the stored ballots of an election from the store
+// and validates them in parallel
+func auditElection(store VoteStore, electionId string, pks []map[string]*big.Int, checkResidues bool, eCfg *electionCfg, workers int, progress func(checked int64)) (report *AuditReport, err error) {
+	votes := make(chan *Vote, 100)
+	done := make(chan *AuditReport)
+	go func() {
+		done <- auditVotes(electionId, votes, pks, checkResidues, eCfg, workers, progress)
+	}()
+	err = store.IterateVotes(electionId, 0, 0, true, func(v *Vote) error {
+		votes <- v
+		return nil
+	})
+	close(votes)
+	report = <-done
+	return
+}
+
+// AuditElection re-validates every stored ballot of an election against the
+// pubkeys currently in electionDir, as the ballotbox would load them. An
+// election not loaded because its pubkeys fail verification is still
+// audited, with the reasons in the report PkErrors. It is used by the
+// ballotbox-admin audit command
+func AuditElection(store VoteStore, electionDir string, electionId string, checkResidues bool, workers int, progress func(checked int64)) (report *AuditReport, err error) {
+	elections, err := loadElectionDir(electionDir, func(string, ...interface{}) {})
+	if err != nil {
+		return
+	}
+	pks, ok := elections.pubkeyObjects[electionId]
+	eCfg := elections.electionCfgs[electionId]
+	rejected, isRejected := elections.rejected[electionId]
+	if !ok && !isRejected {
+		return nil, errors.New("Pks not found for election " + electionId)
+	}
+	if isRejected {
+		pks, eCfg = rejected.pubkeys, rejected.cfg
+	}
+	if report, err = auditElection(store, electionId, pks, checkResidues, eCfg, workers, progress); err != nil {
+		return
+	}
+	if isRejected {
+		report.PkErrors = elections.loadErrors[electionId]
+	}
+	return
+}
+
+// postAudit validates the stored ballots of an election. Residues are
+// checked unless ?check-residues=false is given
+func (bb *BallotBox) postAudit(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+	var err error
+
+	electionId := p.ByName("election_id")
+	if electionId == "" {
+		return &middleware.HandledError{Err: err, Code: 400, Message: "No election_id", CodedMessage: "empty-election-id"}
+	}
+	pks, ok := bb.pubkeyObjects[electionId]
+	if !ok {
+		return &middleware.HandledError{Err: err, Code: 400, Message: "Pks not found for election", CodedMessage: "vote-pks-not-found"}
+	}
+	checkResidues := r.URL.Query().Get("check-residues") != "false"
+
+	s.Server.Logger.Printf("Auditing votes for election %s", electionId)
+	report, err := auditElection(bb.store, electionId, pks, checkResidues, bb.electionCfgs[electionId], 0, func(checked int64) {
+		s.Server.Logger.Printf("Audit of election %s: %d votes checked", electionId, checked)
+	})
+	if err != nil {
+		return &middleware.HandledError{Err: err, Code: 500, Message: "Database error", CodedMessage: "error-select"}
+	}
+	s.Server.Logger.Printf("Audit of election %s finished: %d votes checked, %d invalid", electionId, report.Checked, len(report.Invalid))
+
+	return writeJson(w, http.StatusOK, report)
+}
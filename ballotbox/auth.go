@@ -0,0 +1,180 @@
+package ballotbox
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agoravoting/agora-http-go/middleware"
+	s "github.com/agoravoting/agora-http-go/server"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Voter permissions are checked here instead of by the server CheckPerms, so
+// that each election can have its own secrets. An election directory can
+// hold a secrets_<election-id> file with one HMAC secret per line, all of
+// them are accepted so that a new secret can be added before the old one is
+// removed. The voter tokens of such an election must be signed with one of
+// its secrets. The server SharedSecret is kept for admin permissions, the
+// voter tokens of elections without secrets file are rejected unless the
+// legacyVoterSecret option accepts the SharedSecret for them. Elections with
+// public keys only accept signed tokens, see token.go
+
+// parseSecrets returns the secrets of a secrets file
+func parseSecrets(text string) (secrets []string) {
+	for _, line := range strings.Split(text, "\n") {
+		if secret := strings.TrimSpace(line); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return
+}
+
+// electionSecrets returns the secrets accepted for the voter tokens of an
+// election, nil if it has none and legacyVoterSecret is off
+func (bb *BallotBox) electionSecrets(electionId string) []string {
+	bb.secretsMutex.RLock()
+	defer bb.secretsMutex.RUnlock()
+	if secrets, ok := bb.secrets[electionId]; ok {
+		return secrets
+	}
+	if bb.legacyVoterSecret {
+		return []string{s.Server.SharedSecret}
+	}
+	return nil
+}
+
+// electionAuthKeys returns the public keys of the signed voter tokens of an
+// election, nil if it uses HMAC tokens
+func (bb *BallotBox) electionAuthKeys(electionId string) []crypto.PublicKey {
+	bb.secretsMutex.RLock()
+	defer bb.secretsMutex.RUnlock()
+	return bb.authKeys[electionId]
+}
+
+// voterToken is a valid voter token
+type voterToken struct {
+	// set by one-time tokens, see nonce.go
+	Nonce string
+	// zero if the token doesn't expire
+	Expires time.Time
+}
+
+// authMessage is the signed message of a valid HMAC header
+type authMessage struct {
+	Perm      string
+	Timestamp int64
+	// the nonce of one-time voter tokens or the principal of admin ones
+	Extra string
+}
+
+// verifyAuthHeader returns the message of header if its hmac matches one of
+// secrets and it has not expired, nil otherwise. The header has the
+// <perm>:<timestamp>:<hex hmac-sha256 of perm:timestamp> format of
+// middleware.AuthHeader, or <perm>:<timestamp>:<extra>:<hmac> with the extra
+// field covered by the hmac too. expire is the validity of the token in
+// seconds, 0 for no limit
+func verifyAuthHeader(header string, secrets []string, expire int, now time.Time) *authMessage {
+	sep := strings.LastIndex(header, ":")
+	if sep < 0 {
+		return nil
+	}
+	message := header[:sep]
+	mac, err := hex.DecodeString(header[sep+1:])
+	if err != nil {
+		return nil
+	}
+	fields := strings.SplitN(message, ":", 3)
+	if len(fields) < 2 {
+		return nil
+	}
+	ret := &authMessage{Perm: fields[0]}
+	if ret.Timestamp, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return nil
+	}
+	if len(fields) == 3 {
+		ret.Extra = fields[2]
+	}
+	if age := now.Unix() - ret.Timestamp; expire > 0 && (age > int64(expire) || age < -int64(expire)) {
+		return nil
+	}
+	for _, secret := range secrets {
+		h := hmac.New(sha256.New, []byte(secret))
+		h.Write([]byte(message))
+		if hmac.Equal(mac, h.Sum(nil)) {
+			return ret
+		}
+	}
+	return nil
+}
+
+// checkAuthHeader returns the token of header if it grants perm with one of
+// secrets, nil otherwise. One-time tokens carry their nonce in the extra
+// field, see verifyAuthHeader
+func checkAuthHeader(header string, perm string, secrets []string, expire int, now time.Time) *voterToken {
+	message := verifyAuthHeader(header, secrets, expire, now)
+	if message == nil || message.Perm != perm {
+		return nil
+	}
+	token := &voterToken{Nonce: message.Extra}
+	if expire > 0 {
+		token.Expires = time.Unix(message.Timestamp+int64(expire), 0)
+	}
+	return token
+}
+
+// OneTimeAuthHeader returns a one-time HMAC token granting perm, the
+// middleware.AuthHeader format with a random nonce
+func OneTimeAuthHeader(perm string, secret string) string {
+	message := fmt.Sprintf("%s:%d:%s", perm, time.Now().Unix(), NewNonce())
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(message))
+	return fmt.Sprintf("%s:%x", message, h.Sum(nil))
+}
+
+// expandPerm replaces the ${param} placeholders of a route perm
+func expandPerm(perm string, p httprouter.Params) string {
+	for _, param := range p {
+		perm = strings.Replace(perm, "${"+param.Key+"}", param.Value, -1)
+	}
+	return perm
+}
+
+// voterAuth wraps the handler of a voter route, whose perm has an
+// ${election_id} placeholder, with the check of the voter token
+func (bb *BallotBox) voterAuth(perm string, handler middleware.ErrorHandler) middleware.ErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+		expanded := expandPerm(perm, p)
+		electionId := p.ByName("election_id")
+		header := r.Header.Get("Authorization")
+		var token *voterToken
+		if keys := bb.electionAuthKeys(electionId); keys != nil {
+			if strings.HasPrefix(header, "Bearer ") {
+				token = checkVoterToken(strings.TrimPrefix(header, "Bearer "), expanded, keys, bb.clock())
+			}
+		} else {
+			token = checkAuthHeader(header, expanded, bb.electionSecrets(electionId), bb.sessionExpire, bb.clock())
+		}
+		if token == nil {
+			return &middleware.HandledError{Code: 403, Message: "Invalid or expired voter token", CodedMessage: "invalid-auth"}
+		}
+		// reads don't use up one-time tokens, see nonce.go
+		if r.Method == "GET" {
+			return handler(w, r, p)
+		}
+		used, hErr := bb.checkNonce(electionId, token)
+		if hErr != nil {
+			return hErr
+		}
+		if hErr = handler(w, r, p); hErr != nil && used {
+			bb.releaseNonce(electionId, token)
+		}
+		return hErr
+	}
+}
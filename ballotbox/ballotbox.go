@@ -2,77 +2,175 @@ package ballotbox
 
 import (
 	"github.com/agoravoting/agora-http-go/middleware"
-	"github.com/agoravoting/agora-http-go/util"
 	s "github.com/agoravoting/agora-http-go/server"
 	"github.com/codegangsta/negroni"
-	"github.com/jmoiron/sqlx"
 	"github.com/julienschmidt/httprouter"
 	"encoding/json"
 	"net/http"
-	"io/ioutil"
-	"path"
-	"os"
+	"strconv"
+	"strings"
 	"math/big"
-	"fmt"
+	"time"
+	"sync"
+	"crypto/ed25519"
+	"crypto"
 )
 
 type BallotBox struct {
 	router *httprouter.Router
 	name   string
 
-	insertStmt *sqlx.Stmt
-	getStmt    *sqlx.Stmt
+	// where votes and election states are kept, see store.go
+	store      VoteStore
 	maxWrites  int
 
 	configs map[string]string
 	pubkeys map[string]string
 	pubkeyObjects map[string][]map[string]*big.Int
 	checkResidues bool
+	// how ballot proofs are checked, see verifier.go
+	verifier popkVerifier
 	electionDir string
+
+	electionCfgs map[string]*electionCfg
+	// elections refused on the last load, reported by reload-config
+	loadErrors map[string][]string
+	// grace period applied to both ends of the voting window
+	clockSkew time.Duration
+	// returns the current time, can be replaced in tests
+	clock func() time.Time
+
+	// election lifecycle states
+	states map[string]string
+	statesMutex sync.RWMutex
+	// whether elections with a pk and no stored state are open, see state.go
+	implicitOpen bool
+
+	// whether each election has a census, see census.go
+	census map[string]bool
+	censusMutex sync.RWMutex
+
+	// voter token secrets and public keys of the elections that have their
+	// own, see auth.go and token.go
+	secrets map[string][]string
+	authKeys map[string][]crypto.PublicKey
+	secretsMutex sync.RWMutex
+	// accept the server SharedSecret for the voter tokens of the elections
+	// without secrets or authkeys file
+	legacyVoterSecret bool
+	// validity of the auth tokens in seconds
+	sessionExpire int
+
+	// built on demand, see merkle.go
+	merkleTrees map[string]*merkleTree
+	merkleMutex sync.Mutex
+	signingKey ed25519.PrivateKey
 }
 
 func (bb *BallotBox) Name() string {
 	return bb.name
 }
 
+// route is an endpoint of the module, perm is the permission required to
+// call it, with ${param} placeholders, or empty if it is public
+type route struct {
+	method  string
+	path    string
+	perm    string
+	handler func(http.ResponseWriter, *http.Request, httprouter.Params) *middleware.HandledError
+}
+
+func (bb *BallotBox) routes() []route {
+	return []route{
+		{"POST", "/election/:election_id/vote/:voter_id", "voter-${election_id}-${voter_id}", bb.postVote},
+		{"GET", "/election/:election_id/check-hash/:voter_id/:vote_hash", "voter-${election_id}-${voter_id}", bb.checkHash},
+		{"GET", "/election/:election_id/config", "", bb.getElectionConfig},
+		{"GET", "/election/:election_id/pubkeys", "", bb.getElectionPubKeys},
+		{"GET", "/election/:election_id/bulletin-board", "", bb.getBulletinBoard},
+		{"GET", "/signing-key", "", bb.getSigningKey},
+		{"GET", "/election/:election_id/merkle-root", "", bb.getMerkleRoot},
+		{"GET", "/election/:election_id/inclusion-proof/:vote_hash", "", bb.getInclusionProof},
+
+		// admin routes, see admin.go
+		{"POST", "/reload-config", PermGlobalAdmin, bb.reloadConfig},
+		{"POST", "/election/:election_id/audit", "admin-${election_id}-read", bb.postAudit},
+		{"GET", "/election/:election_id/voter/:voter_id/history", "admin-${election_id}-read", bb.getVoterHistory},
+		{"GET", "/election/:election_id/census", "admin-${election_id}-read", bb.getCensus},
+		{"POST", "/election/:election_id/census", "admin-${election_id}-write", bb.postCensus},
+		{"DELETE", "/election/:election_id/census/:voter_id", "admin-${election_id}-write", bb.deleteCensusVoter},
+		{"GET", "/election/:election_id/state", "admin-${election_id}-read", bb.getElectionState},
+		{"POST", "/election/:election_id/state/:state", "admin-${election_id}-write", bb.setElectionState},
+	}
+}
+
+// authHandler returns the handler of a route with the check of its perm,
+// voter tokens are checked with the election secrets and admin tokens
+// against the scope of the route
+func (bb *BallotBox) authHandler(r route) middleware.ErrorHandler {
+	if r.perm == "" {
+		return r.handler
+	} else if strings.HasPrefix(r.perm, "voter-") {
+		return bb.voterAuth(r.perm, r.handler)
+	}
+	return bb.adminAuth(r.perm, r.handler)
+}
+
 func (bb *BallotBox) Init(cfg map[string]*json.RawMessage) (err error) {
 	var ballotboxSessionExpire int
 	json.Unmarshal(*cfg["ballotboxSessionExpire"], &ballotboxSessionExpire)
-	var maxWrites int
-	json.Unmarshal(*cfg["maxWrites"], &maxWrites)
-	bb.maxWrites = maxWrites
+	bb.sessionExpire = ballotboxSessionExpire
 
 	// setup the routes
 	bb.router = httprouter.New()
-	bb.router.POST("/election/:election_id/vote/:voter_id", middleware.Join(
-		s.Server.ErrorWrap.Do(bb.postVote),
-		s.Server.CheckPerms("voter-${election_id}-${voter_id}", ballotboxSessionExpire)))
-	bb.router.GET("/election/:election_id/check-hash/:voter_id/:vote_hash", middleware.Join(
-		s.Server.ErrorWrap.Do(bb.checkHash),
-		s.Server.CheckPerms("voter-${election_id}-${voter_id}", ballotboxSessionExpire)))
-	bb.router.GET("/election/:election_id/config", middleware.Join(
-		s.Server.ErrorWrap.Do(bb.getElectionConfig)))
-	bb.router.GET("/election/:election_id/pubkeys", middleware.Join(
-		s.Server.ErrorWrap.Do(bb.getElectionPubKeys)))
-
-	// admin routes
-	bb.router.POST("/reload-config", middleware.Join(
-		s.Server.ErrorWrap.Do(bb.reloadConfig),
-		s.Server.CheckPerms("admin", ballotboxSessionExpire)))
-
-	// setup prepared sql queries
-	if bb.insertStmt, err = s.Server.Db.Preparex("SELECT set_vote($1, $2, $3, $4, $5, $6)"); err != nil {
+	for _, r := range bb.routes() {
+		bb.router.Handle(r.method, r.path, middleware.Join(
+			s.Server.ErrorWrap.Do(bb.authHandler(r))))
+	}
+
+	if err = bb.configure(cfg); err != nil {
 		return
 	}
-	if bb.getStmt, err = s.Server.Db.Preparex("SELECT id, vote, vote_hash, election_id, voter_id FROM votes WHERE election_id = $1 and voter_id = $2 and vote_hash = $3"); err != nil {
+
+	// add the routes to the server
+	handler := negroni.New(negroni.Wrap(bb.router))
+	s.Server.Mux.OnMux("api/v1/ballotbox", handler)
+	return
+}
+
+// configure reads the module config, opens the vote store and loads the
+// elections. It doesn't touch the server routes
+func (bb *BallotBox) configure(cfg map[string]*json.RawMessage) (err error) {
+	var maxWrites int
+	json.Unmarshal(*cfg["maxWrites"], &maxWrites)
+	bb.maxWrites = maxWrites
+
+	if bb.store, err = openVoteStore(cfg); err != nil {
 		return
 	}
 
+	// optional, true keeps the elections with a pk and no stored state open
+	// as they were before the lifecycle states
+	bb.implicitOpen = true
+	if value, ok := cfg["implicitOpen"]; ok {
+		json.Unmarshal(*value, &bb.implicitOpen)
+	}
+
+	// optional, false rejects the voter tokens of the elections without
+	// secrets file
+	bb.legacyVoterSecret = false
+	if value, ok := cfg["legacyVoterSecret"]; ok {
+		json.Unmarshal(*value, &bb.legacyVoterSecret)
+	}
+
 	var electionDir string
 	json.Unmarshal(*cfg["electionDir"], &electionDir)
 	s.Server.Logger.Printf("Loading cfgs from %s", electionDir)
 	bb.electionDir = electionDir
 
+	if bb.signingKey, err = loadSigningKey(cfg); err != nil {
+		return
+	}
+
 	// initialize election cfgs to return in getConfig
 	err = bb.readElectionCfgs()
 	if(err != nil) {
@@ -81,119 +179,92 @@ func (bb *BallotBox) Init(cfg map[string]*json.RawMessage) (err error) {
 
 	json.Unmarshal(*cfg["checkResidues"], &bb.checkResidues)
 
-	// add the routes to the server
-	handler := negroni.New(negroni.Wrap(bb.router))
-	s.Server.Mux.OnMux("api/v1/ballotbox", handler)
+	// optional, in seconds
+	if value, ok := cfg["clockSkew"]; ok {
+		var clockSkew int
+		json.Unmarshal(*value, &clockSkew)
+		bb.clockSkew = time.Duration(clockSkew) * time.Second
+	}
+
+	// optional, "sequential" (default), "parallel" or "batch", the batch
+	// window is in milliseconds
+	var (
+		proofVerifier    string
+		proofBatchWindow int
+		proofBatchSize   int
+	)
+	if value, ok := cfg["proofVerifier"]; ok {
+		json.Unmarshal(*value, &proofVerifier)
+	}
+	if value, ok := cfg["proofBatchWindow"]; ok {
+		json.Unmarshal(*value, &proofBatchWindow)
+	}
+	if value, ok := cfg["proofBatchSize"]; ok {
+		json.Unmarshal(*value, &proofBatchSize)
+	}
+	if bb.verifier, err = newPopkVerifier(proofVerifier, time.Duration(proofBatchWindow)*time.Millisecond, proofBatchSize); err != nil {
+		return
+	}
 	return
 }
 
 func (bb *BallotBox) readElectionCfgs() (err error) {
-	var configs = make(map[string]string)
-	var pubkeys = make(map[string]string)
-	var pubkeyObjects = make(map[string][]map[string]*big.Int)
+	elections, err := loadElectionDir(bb.electionDir, s.Server.Logger.Printf)
+	if err != nil {
+		return
+	}
 
-	files, err := ioutil.ReadDir(bb.electionDir)
-	if(err != nil) {
-		s.Server.Logger.Printf("Could not read election dir at %s", bb.electionDir)
+	bb.configs = elections.configs
+	bb.pubkeys = elections.pubkeys
+	bb.pubkeyObjects = elections.pubkeyObjects
+	bb.electionCfgs = elections.electionCfgs
+	bb.loadErrors = elections.loadErrors
+
+	states, err := bb.loadStates(elections.configs)
+	if err != nil {
+		s.Server.Logger.Printf("Could not read election states %v", err)
 		return
 	}
+	bb.statesMutex.Lock()
+	bb.states = states
+	bb.statesMutex.Unlock()
 
-	for _, f := range files {
-		if(f.IsDir()) {
-			// read config.json
-			cfgPath := path.Join(bb.electionDir, f.Name(), "config.json")
-			var cfgText string
-			cfgText, err = util.Contents(cfgPath)
-			if(err != nil) {
-				s.Server.Logger.Printf("Could not read config.json at %s %v, skipping", cfgPath, err)
-				continue
-			} else {
-				s.Server.Logger.Printf("Reading %s", cfgPath)
-			}
-			var cfg map[string]*json.RawMessage
-			err = json.Unmarshal([]byte(cfgText), &cfg)
-			if err != nil {
-				s.Server.Logger.Printf("Error reading config file %s %v, skipping", cfgPath, err)
-				continue
-			}
-			var electionId string
-			value, ok := cfg["election-id"]
-			if !ok {
-				electionId = f.Name()
-			} else {
-				json.Unmarshal(*value, &electionId)
-			}
-
-			s.Server.Logger.Printf("Loaded config file for election %s", electionId)
-			configs[electionId] = cfgText
-
-			// read pk_<election-id>
-			pkPath := path.Join(bb.electionDir, f.Name(), "pk_" + electionId)
-			var pkText string
-			if _, err := os.Stat(pkPath); os.IsNotExist(err) {
-				s.Server.Logger.Printf("No pubkey at %s", pkPath)
-				continue
-			}
-			pkText, err = util.Contents(pkPath)
-			if(err != nil) {
-				s.Server.Logger.Printf("Could not read pubkey at %s %v, skipping", pkPath, err)
-				continue
-			} else {
-				s.Server.Logger.Printf("Reading %s", pkPath)
-			}
-			var pk []interface{}
-			err = json.Unmarshal([]byte(pkText), &pk)
-			if err != nil {
-				s.Server.Logger.Printf("Error reading pubkey file %s %v, skipping", pkPath, err)
-				continue
-			}
-			pubkeys[electionId] = pkText
-
-			var pksDecoded []interface{}
-			if err := json.Unmarshal([]byte(pkText), &pksDecoded); err != nil {
-    			s.Server.Logger.Printf("Error reading pubkey file %s %v, skipping", pkPath, err)
-				continue
-    		}
-
-    		keys := make([]map[string]*big.Int, len(pksDecoded))
-
-    		for index,element := range pksDecoded {
-    			next := element.(map[string]interface{})
-    			_modulus := next["p"].(string)
-    			_generator := next["g"].(string)
-
-    			modulus := big.NewInt(0)
-        		_, ok := modulus.SetString(_modulus, 10)
-        		if ! ok {
-        			s.Server.Logger.Printf("Error reading pubkey(p) file %s, skipping", pkPath)
-					continue
-        		}
-        		generator := big.NewInt(0)
-        		_, ok = generator.SetString(_generator, 10)
-        		if ! ok {
-        			s.Server.Logger.Printf("Error reading pubkey(g) file %s, skipping", pkPath)
-					continue
-        		}
-        		key := make(map[string]*big.Int)
-        		key["p"] = modulus
-        		key["g"] = generator
-
-        		keys[index] = key
-    		}
-    		pubkeyObjects[electionId] = keys
-		}
+	census, err := bb.loadCensus(elections)
+	if err != nil {
+		s.Server.Logger.Printf("Could not load the census %v", err)
+		return
 	}
+	bb.censusMutex.Lock()
+	bb.census = census
+	bb.censusMutex.Unlock()
+
+	bb.secretsMutex.Lock()
+	bb.secrets = elections.secrets
+	bb.authKeys = elections.authKeys
+	bb.secretsMutex.Unlock()
 
-	bb.configs = configs
-	bb.pubkeys = pubkeys
-	bb.pubkeyObjects = pubkeyObjects
+	bb.merkleMutex.Lock()
+	bb.merkleTrees = make(map[string]*merkleTree)
+	bb.merkleMutex.Unlock()
 
 	return
 }
 
+// writeJson sends data json encoded with the given status code
+func writeJson(w http.ResponseWriter, code int, data interface{}) *middleware.HandledError {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return &middleware.HandledError{Err: err, Code: 500, Message: "Error marshalling the data", CodedMessage: "marshall-error"}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+	return nil
+}
+
 func (bb *BallotBox) checkHash(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
 	var (
-		v   []Vote
+		v   *Vote
 		err error
 		voteHash string
 	)
@@ -210,17 +281,19 @@ func (bb *BallotBox) checkHash(w http.ResponseWriter, r *http.Request, p httprou
 	if voteHash == "" {
 		return &middleware.HandledError{Err: err, Code: 400, Message: "Invalid hash format", CodedMessage: "invalid-format"}
 	}
+	if hErr := bb.checkElectionStarted(electionId); hErr != nil {
+		return hErr
+	}
 
-
-	if err = bb.getStmt.Select(&v, electionId, voterId, voteHash); err != nil {
+	if v, err = bb.store.FindVote(electionId, voterId, voteHash); err != nil {
 		return &middleware.HandledError{Err: err, Code: 500, Message: "Database error", CodedMessage: "error-select"}
 	}
 
-	if len(v) == 0 {
+	if v == nil {
 		return &middleware.HandledError{Err: err, Code: 404, Message: "Not found", CodedMessage: "not-found"}
 	}
 
-	b, err := v[0].Marshal()
+	b, err := v.Marshal()
 	if err != nil {
 		return &middleware.HandledError{Err: err, Code: 500, Message: "Error marshalling the data", CodedMessage: "marshall-error"}
 	}
@@ -273,7 +346,6 @@ func (bb *BallotBox) getElectionPubKeys(w http.ResponseWriter, r *http.Request,
 
 func (bb *BallotBox) postVote(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
 	var (
-		tx    = s.Server.Db.MustBegin()
 		vote  Vote
 		err   error
 	)
@@ -295,34 +367,61 @@ func (bb *BallotBox) postVote(w http.ResponseWriter, r *http.Request, p httprout
 	if voterId == "" {
 		return &middleware.HandledError{Err: err, Code: 400, Message: "No voter_id", CodedMessage: "empty-voter-id"}
 	}
+	eCfg, ok := bb.electionCfgs[electionId]
+	if !ok {
+		return &middleware.HandledError{Err: err, Code: 404, Message: "Election not found", CodedMessage: "election-not-found"}
+	}
+	switch bb.electionState(electionId) {
+	case StateOpen:
+	case StatePaused:
+		return &middleware.HandledError{Err: err, Code: 403, Message: "Election paused", CodedMessage: "election-paused"}
+	case StateClosed, StateTallied:
+		return &middleware.HandledError{Err: err, Code: 403, Message: "Election closed", CodedMessage: "election-closed"}
+	default:
+		return &middleware.HandledError{Err: err, Code: 403, Message: "Election not open yet", CodedMessage: "election-not-open"}
+	}
+	if err = eCfg.checkVotingWindow(bb.clock(), bb.clockSkew); err != nil {
+		if err == ErrElectionNotOpen {
+			return &middleware.HandledError{Err: err, Code: 403, Message: "Election not open yet", CodedMessage: "election-not-open"}
+		}
+		return &middleware.HandledError{Err: err, Code: 403, Message: "Election closed", CodedMessage: "election-closed"}
+	}
+	if hErr := bb.checkCensus(electionId, voterId); hErr != nil {
+		return hErr
+	}
 	pks, ok := bb.pubkeyObjects[electionId]
     if ! ok {
     	return &middleware.HandledError{Err: err, Code: 400, Message: "Pks not found for election", CodedMessage: "vote-pks-not-found"}
     }
-    if err := vote.validate(pks, bb.checkResidues); err != nil {
+    if err := vote.validate(pks, bb.checkResidues, eCfg, bb.verifier); err != nil {
+		if bErr, ok := err.(*BallotError); ok {
+			return &middleware.HandledError{Err: err, Code: 400, Message: bErr.Message, CodedMessage: bErr.Code}
+		}
     	return &middleware.HandledError{Err: err, Code: 400, Message: "Vote validation failed", CodedMessage: "vote-validation-failedj"}
     }
 
-	encryptedVoteString := vote.Vote
-
-	var updated string
-	if err = bb.insertStmt.Get(&updated, encryptedVoteString, vote.VoteHash, electionId, voterId, ip, bb.maxWrites); err != nil {
-		tx.Rollback()
-		return &middleware.HandledError{Err: err, Code: 500, Message: "Error calling set_vote", CodedMessage: "error-upsert"}
-	}
-
-	err = tx.Commit()
+	vote.ElectionId = electionId
+	vote.VoterId = voterId
+	result, err := bb.store.CastVote(&vote, ip, eCfg.castLimits(bb.maxWrites))
 	if err != nil {
-		tx.Rollback()
-		return &middleware.HandledError{Err: err, Code: 500, Message: "Error comitting the vote", CodedMessage: "error-commit"}
+		return &middleware.HandledError{Err: err, Code: 500, Message: "Error casting the vote", CodedMessage: "error-upsert"}
 	}
 
-	w.WriteHeader(http.StatusAccepted)
-	w.Header().Set("Content-Type", "application/json")
-	var json = fmt.Sprintf("{\"updated\": \"%s\"}", updated)
-	w.Write([]byte(json))
+	ret := map[string]interface{}{"updated": strconv.FormatBool(result == CastStored)}
+	switch result {
+	case CastStored:
+		bb.addToMerkleTree(electionId, vote.Id, vote.VoteHash)
+		ret["receipt"] = bb.newReceipt(electionId, vote.VoteHash, vote.WriteCount)
+	case CastMaxWrites:
+		return &middleware.HandledError{Err: err, Code: 403, Message: "No more casts allowed for this voter", CodedMessage: "revote-not-allowed"}
+	case CastCooldown:
+		return &middleware.HandledError{Err: err, Code: 429, Message: "Too soon since the previous cast", CodedMessage: "revote-cooldown"}
+	case CastRecorded:
+		// first-vote-counts, kept in the vote history only
+		ret["recorded"] = "true"
+	}
 
-	return nil
+	return writeJson(w, http.StatusAccepted, ret)
 }
 
 func (bb *BallotBox) reloadConfig(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
@@ -330,13 +429,9 @@ func (bb *BallotBox) reloadConfig(w http.ResponseWriter, r *http.Request, p http
 	if(err != nil) {
 		return &middleware.HandledError{Err: err, Code: 500, Message: "Error calling set_vote", CodedMessage: "error-upsert"}
 	}
-	w.WriteHeader(http.StatusAccepted)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte("{}"))
-
-	return nil
+	return writeJson(w, http.StatusAccepted, map[string]interface{}{"errors": bb.loadErrors})
 }
 
 func init() {
-	s.Server.AvailableModules = append(s.Server.AvailableModules, &BallotBox{name: "github.com/agoravoting/agora-api/ballotbox"})
+	s.Server.AvailableModules = append(s.Server.AvailableModules, &BallotBox{name: "github.com/agoravoting/agora-api/ballotbox", clock: time.Now})
 }
\ No newline at end of file
@@ -3,41 +3,47 @@ package ballotbox
 import (
 	"fmt"
 	"github.com/agoravoting/agora-http-go/middleware"
-	stest "github.com/agoravoting/agora-http-go/server/testing"
+	s "github.com/agoravoting/agora-http-go/server"
 	"net/http"
 	"testing"
 	"bytes"
 	"time"
+	"encoding/json"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"encoding/base64"
 
 	"flag"
 	"strconv"
 	"os"
     "crypto/tls"
     "strings"
+	"math/big"
+	"io/ioutil"
+	"path"
+	"log"
+	"net/http/httptest"
+
+	"filippo.io/nistec"
+	"github.com/julienschmidt/httprouter"
 )
 
 var (
 	port int
     host *string
-	// sharedsecret duplicated here, once used in below test, the other in config passed to server, must match.
 	SharedSecret = "somesecret"
     newVoteJson string
     newVoteHash string
-	Config       = `{
-	"Debug": true,
-	"DbMaxIddleConnections": 5,
-	"DbConnectString": "user=ballotbox password=ballotbox dbname=ballotbox_test sslmode=disable",
-    "ballotboxSessionExpire": 1000000,
-	"maxWrites": 2,
-    "SharedSecret": "somesecret",
-	"Admins": ["test@example.com"],
-	"ActiveModules": [
-		"github.com/agoravoting/agora-api/ballotbox"
-	],
-	"RavenDSN": "",
-    "electionDir": "../admin/elections",
-    "checkResidues": true
-}`
+
 )
 
 const (
@@ -50,50 +56,2059 @@ const (
     }`
 )
 
-func TestAgoraApi(t *testing.T) {
-	ts := stest.New(t, Config)
-	defer ts.TearDown()
-	voteAuth := map[string]string{"Authorization": middleware.AuthHeader("voter-1020-1", SharedSecret)}
-    adminAuth := map[string]string{"Authorization": middleware.AuthHeader("admin", SharedSecret)}
-    fmt.Printf("%v", adminAuth)
+// the test election 1020 was open in december 2013
+var electionOpen = time.Date(2013, 12, 7, 12, 0, 0, 0, time.UTC)
+
+// opens the election for voting, admin only
+func openElection(tb *testBallotBox, electionId string) {
+	adminAuth := map[string]string{"Authorization": middleware.AuthHeader("admin", SharedSecret)}
+	tb.RequestJson("POST", fmt.Sprintf("/api/v1/ballotbox/election/%s/state/%s", electionId, StateOpen), http.StatusOK, adminAuth, "")
+}
+
+func TestImplicitState(t *testing.T) {
+	if state := implicitState(true, true); state != StateOpen {
+		t.Fatalf("Elections with pk should be open by default, got %s", state)
+	}
+	if state := implicitState(true, false); state != StateKeysReady {
+		t.Fatalf("Elections with pk should be keys-ready without implicitOpen, got %s", state)
+	}
+	if state := implicitState(false, true); state != StateCreated {
+		t.Fatalf("Elections without pk should be created, got %s", state)
+	}
+}
+
+func TestStateTransitions(t *testing.T) {
+	valid := [][]string{
+		{StateCreated, StateKeysReady},
+		{StateKeysReady, StateOpen},
+		{StateOpen, StatePaused},
+		{StatePaused, StateOpen},
+		{StateOpen, StateClosed},
+		{StatePaused, StateClosed},
+		{StateClosed, StateTallied},
+	}
+	for _, transition := range valid {
+		if !validTransition(transition[0], transition[1]) {
+			t.Fatalf("Transition %s -> %s should be valid", transition[0], transition[1])
+		}
+	}
+	invalid := [][]string{
+		{StateCreated, StateOpen},
+		{StateClosed, StateOpen},
+		{StateTallied, StateOpen},
+		{StateOpen, StateKeysReady},
+		{StateOpen, "bogus"},
+	}
+	for _, transition := range invalid {
+		if validTransition(transition[0], transition[1]) {
+			t.Fatalf("Transition %s -> %s should be invalid", transition[0], transition[1])
+		}
+	}
+}
+
+func TestListElections(t *testing.T) {
+	elections, err := ListElections("../admin/elections", true, func(string, ...interface{}) {})
+	if err != nil {
+		t.Fatalf("Error listing elections %v", err)
+	}
+	if len(elections) != 1 {
+		t.Fatalf("Expected the test election, got %v", elections)
+	}
+	e := elections[0]
+	if e.Id != "1020" || e.Director != "wadobo-auth1" || !e.Pk || e.Tally || e.State != StateOpen || e.Error != "" {
+		t.Fatalf("Unexpected election info %v", e)
+	}
+
+	// broken elections are listed with the reason
+	dir := t.TempDir()
+	for id, files := range map[string]map[string]string{
+		"1":         {"config.json": `{"director": "d"}`},
+		"2":         {"config.json": `{"director": `},
+		"3":         {},
+		"4":         {"config.json": `{}`, "pk_4": `[{`},
+		"directory": {"config.json": `{"election-id": "5"}`, "pk_5": `[]`},
+	} {
+		os.Mkdir(path.Join(dir, id), 0755)
+		for name, text := range files {
+			ioutil.WriteFile(path.Join(dir, id, name), []byte(text), 0644)
+		}
+	}
+	if elections, err = ListElections(dir, false, func(string, ...interface{}) {}); err != nil {
+		t.Fatalf("Error listing elections %v", err)
+	}
+	if len(elections) != 5 {
+		t.Fatalf("Expected every directory, got %v", elections)
+	}
+	for i, expected := range []struct {
+		id    string
+		pk    bool
+		state string
+		error string
+	}{
+		{"1", false, StateCreated, ""},
+		{"2", false, "", "Invalid config.json"},
+		{"3", false, "", "Could not read config.json"},
+		{"4", false, StateCreated, "Invalid pubkey file"},
+		{"5", true, StateKeysReady, ""},
+	} {
+		e := elections[i]
+		if e.Id != expected.id || e.Pk != expected.pk || e.State != expected.state || !strings.HasPrefix(e.Error, expected.error) || (expected.error == "") != (e.Error == "") {
+			t.Fatalf("Unexpected election info %v, expected %v", e, expected)
+		}
+	}
+}
+
+func TestAuditVotes(t *testing.T) {
+	elections, err := loadElectionDir("../admin/elections", func(string, ...interface{}) {})
+	if err != nil {
+		t.Fatalf("Error loading elections %v", err)
+	}
+	vote := strings.Replace(voteJson, `\"`, `"`, -1)
+	votes := make(chan *Vote, 4)
+	votes <- &Vote{Id: 1, Vote: vote, VoteHash: newVoteHash, VoterId: "1"}
+	votes <- &Vote{Id: 2, Vote: vote, VoteHash: HashSha256("bogus"), VoterId: "2"}
+	votes <- &Vote{Id: 3, Vote: "{}", VoteHash: HashSha256("{}"), VoterId: "3"}
+	votes <- &Vote{Id: 4, Vote: "not json", VoteHash: HashSha256("not json"), VoterId: "4"}
+	close(votes)
+
+	report := auditVotes("1020", votes, elections.pubkeyObjects["1020"], true, nil, 2, nil)
+	if report.Checked != 4 || len(report.Invalid) != 3 {
+		t.Fatalf("Unexpected audit report %v", report)
+	}
+	for i, invalid := range report.Invalid {
+		if invalid.Id != int64(i+2) || invalid.Reason == "" {
+			t.Fatalf("Unexpected invalid ballot %v", invalid)
+		}
+	}
+}
+
+func TestAuditRejectedPubkeys(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(path.Join(dir, "1020"), 0755)
+	cfgText, _ := ioutil.ReadFile("../admin/elections/1020/config.json")
+	ioutil.WriteFile(path.Join(dir, "1020", "config.json"), cfgText, 0644)
+	pkText, _ := ioutil.ReadFile("../admin/elections/1020/pk_1020")
+	var pks []map[string]interface{}
+	json.Unmarshal(pkText, &pks)
+	// p - 1 has order 2
+	p, _ := new(big.Int).SetString(pks[1]["p"].(string), 10)
+	pks[1]["y"] = new(big.Int).Sub(p, bigOne).String()
+	pkText, _ = json.Marshal(pks)
+	ioutil.WriteFile(path.Join(dir, "1020", "pk_1020"), pkText, 0644)
+
+	store := newMemoryStore()
+	vote := strings.Replace(voteJson, `\"`, `"`, -1)
+	if _, err := store.CastVote(&Vote{Vote: vote, VoteHash: HashSha256(vote), ElectionId: "1020", VoterId: "1"}, "127.0.0.1", CastLimits{}); err != nil {
+		t.Fatalf("Error casting vote %v", err)
+	}
+	report, err := AuditElection(store, dir, "1020", true, 1, nil)
+	if err != nil {
+		t.Fatalf("The audit should go on with invalid pubkeys, got %v", err)
+	}
+	if report.Checked != 1 || len(report.PkErrors) != 1 || !strings.HasPrefix(report.PkErrors[0], "pk 1:") {
+		t.Fatalf("Unexpected audit report %v", report)
+	}
+	if _, err = AuditElection(store, dir, "1021", true, 1, nil); err == nil {
+		t.Fatalf("Elections without pubkeys can't be audited")
+	}
+}
+
+func TestElectionHash(t *testing.T) {
+	hash, err := electionConfigHash(`{"b": [1, 2.50, "<a>"], "a": {"d": "ñ", "c": 10000000000000000001}}`)
+	if err != nil {
+		t.Fatalf("Error hashing config %v", err)
+	}
+	if hash != HashSha256(`{"a":{"c":10000000000000000001,"d":"ñ"},"b":[1,2.50,"<a>"]}`) {
+		t.Fatalf("Unexpected canonical config hash")
+	}
+
+	elections, err := loadElectionDir("../admin/elections", func(string, ...interface{}) {})
+	if err != nil {
+		t.Fatalf("Error loading elections %v", err)
+	}
+	pks := elections.pubkeyObjects["1020"]
+	expected := elections.electionCfgs["1020"].Hash
+	if expected == "" || elections.electionCfgs["1020"].expectedHash() != "" {
+		t.Fatalf("Election hash should be computed but not checked for 1020")
+	}
+
+	encryptedVote, err := ParseEncryptedVote([]byte(strings.Replace(voteJson, `\"`, `"`, -1)))
+	if err != nil {
+		t.Fatalf("Error parsing vote %v", err)
+	}
+	eCfg := &electionCfg{Hash: expected, CheckElectionHash: true}
+	if err = encryptedVote.validate(pks, false, eCfg, nil); err != ErrElectionHashMismatch {
+		t.Fatalf("Expected election hash mismatch, got %v", err)
+	}
+	encryptedVote.ElectionHash.Value = expected
+	if err = encryptedVote.validate(pks, false, eCfg, nil); err != nil {
+		t.Fatalf("Vote with the election hash rejected %v", err)
+	}
+}
+
+func TestBallotStructure(t *testing.T) {
+	elections, err := loadElectionDir("../admin/elections", func(string, ...interface{}) {})
+	if err != nil {
+		t.Fatalf("Error loading elections %v", err)
+	}
+	pks := elections.pubkeyObjects["1020"]
+	eCfg := elections.electionCfgs["1020"]
+	if eCfg.numQuestions() != 3 {
+		t.Fatalf("Expected 3 questions for 1020, got %d", eCfg.numQuestions())
+	}
+	vote := strings.Replace(voteJson, `\"`, `"`, -1)
+
+	cases := []struct {
+		mutate   func(e *EncryptedVote)
+		pks      []map[string]*big.Int
+		expected error
+	}{
+		{func(e *EncryptedVote) { e.Choices = e.Choices[:2] }, pks, ErrInvalidChoicesCount},
+		{func(e *EncryptedVote) { e.Choices = append(e.Choices, e.Choices[0]) }, pks, ErrInvalidChoicesCount},
+		{func(e *EncryptedVote) { e.Proofs = e.Proofs[:2] }, pks, ErrInvalidProofsCount},
+		{func(e *EncryptedVote) { e.Choices[1] = nil }, pks, ErrMissingChoice},
+		{func(e *EncryptedVote) { e.Proofs[2] = nil }, pks, ErrMissingProof},
+		{func(e *EncryptedVote) {}, []map[string]*big.Int{pks[0], nil, pks[2]}, ErrInvalidPubkey},
+		{func(e *EncryptedVote) {}, pks[:2], ErrInvalidChoicesCount},
+	}
+	for i, c := range cases {
+		encryptedVote, err := ParseEncryptedVote([]byte(vote))
+		if err != nil {
+			t.Fatalf("Error parsing vote %v", err)
+		}
+		c.mutate(encryptedVote)
+		if err = encryptedVote.validate(c.pks, false, eCfg, nil); err != c.expected {
+			t.Fatalf("Case %d: expected %v, got %v", i, c.expected, err)
+		}
+	}
+
+	// same number of choices and pubkeys but not of questions
+	encryptedVote, _ := ParseEncryptedVote([]byte(vote))
+	if err = encryptedVote.validate(pks, false, &electionCfg{NumQuestions: 2}, nil); err != ErrInvalidChoicesCount {
+		t.Fatalf("Expected invalid choices count, got %v", err)
+	}
+	if err = encryptedVote.validate(pks, false, eCfg, nil); err != nil {
+		t.Fatalf("Valid vote rejected %v", err)
+	}
+}
+
+// malformed ballots must be rejected with an error, never a panic
+func FuzzParseEncryptedVote(f *testing.F) {
+	f.Add([]byte(strings.Replace(voteJson, `\"`, `"`, -1)))
+	f.Add([]byte(`{"a":"encrypted-vote-v1","choices":[null],"proofs":[{}]}`))
+	f.Add([]byte(`{}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ParseEncryptedVote(data)
+	})
+}
+
+func FuzzVoteValidate(f *testing.F) {
+	elections, err := loadElectionDir("../admin/elections", func(string, ...interface{}) {})
+	if err != nil {
+		f.Fatalf("Error loading elections %v", err)
+	}
+	pks := elections.pubkeyObjects["1020"]
+	eCfg := elections.electionCfgs["1020"]
+
+	f.Add(strings.Replace(voteJson, `\"`, `"`, -1))
+	f.Add(`{"a":"encrypted-vote-v1","choices":[null,null,null],"proofs":[null,null,null],"election_hash":{"a":"hash/sha256/value"},"issue_date":"x"}`)
+	f.Add(`{"a":"encrypted-vote-v1","choices":[{"alpha":"0","beta":"0"}],"proofs":[{"challenge":"0","commitment":"0","response":"0"}],"election_hash":{"a":"hash/sha256/value"},"issue_date":"x"}`)
+	f.Fuzz(func(t *testing.T, vote string) {
+		v := &Vote{Vote: vote}
+		v.validate(pks, false, eCfg, nil)
+	})
+}
+
+func TestVerifyPubkey(t *testing.T) {
+	pkText, err := ioutil.ReadFile("../admin/elections/1020/pk_1020")
+	if err != nil {
+		t.Fatalf("Error reading pubkey %v", err)
+	}
+	keys, diagnostics := parsePubkeys(string(pkText))
+	if diagnostics != nil || len(keys) != 3 {
+		t.Fatalf("Valid pubkeys refused %v", diagnostics)
+	}
+
+	key := func(changes map[string]*big.Int) map[string]*big.Int {
+		ret := make(map[string]*big.Int)
+		for name, value := range keys[0] {
+			ret[name] = value
+		}
+		for name, value := range changes {
+			ret[name] = value
+		}
+		return ret
+	}
+	p := keys[0]["p"]
+	pMinusOne := new(big.Int).Sub(p, big.NewInt(1))
+	cases := []map[string]*big.Int{
+		// 23 = 2 * 11 + 1 is a safe prime, but too small
+		{"p": big.NewInt(23), "q": big.NewInt(11), "g": big.NewInt(4), "y": big.NewInt(2)},
+		key(map[string]*big.Int{"q": new(big.Int).Add(keys[0]["q"], big.NewInt(1))}),
+		key(map[string]*big.Int{"p": new(big.Int).Add(p, big.NewInt(2)), "q": new(big.Int).Add(keys[0]["q"], big.NewInt(1))}),
+		// order 2
+		key(map[string]*big.Int{"g": pMinusOne}),
+		key(map[string]*big.Int{"g": big.NewInt(1)}),
+		key(map[string]*big.Int{"y": pMinusOne}),
+		key(map[string]*big.Int{"y": p}),
+		key(map[string]*big.Int{"y": big.NewInt(0)}),
+	}
+	for i, c := range cases {
+		if err := verifyPubkey(c, make(map[string]bool)); err == nil {
+			t.Fatalf("Case %d: invalid pubkey accepted", i)
+		}
+	}
+
+	// one diagnostic per invalid key, the election is refused
+	var pks []map[string]string
+	json.Unmarshal(pkText, &pks)
+	pks[1]["y"] = pMinusOne.String()
+	delete(pks[2], "q")
+	invalid, _ := json.Marshal(pks)
+	dir, err := ioutil.TempDir("", "elections")
+	if err != nil {
+		t.Fatalf("Error creating election dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(path.Join(dir, "1"), 0755)
+	ioutil.WriteFile(path.Join(dir, "1", "config.json"), []byte(`{"election-id": "1"}`), 0644)
+	ioutil.WriteFile(path.Join(dir, "1", "pk_1"), invalid, 0644)
+
+	elections, err := loadElectionDir(dir, func(string, ...interface{}) {})
+	if err != nil {
+		t.Fatalf("Error loading elections %v", err)
+	}
+	if _, ok := elections.configs["1"]; ok {
+		t.Fatalf("Election with invalid pubkeys loaded")
+	}
+	if diagnostics := elections.loadErrors["1"]; len(diagnostics) != 2 || !strings.HasPrefix(diagnostics[0], "pk 1:") || !strings.HasPrefix(diagnostics[1], "pk 2:") {
+		t.Fatalf("Unexpected load errors %v", elections.loadErrors)
+	}
+}
+
+func TestQuadraticResidue(t *testing.T) {
+	elections, err := loadElectionDir("../admin/elections", func(string, ...interface{}) {})
+	if err != nil {
+		t.Fatalf("Error loading elections %v", err)
+	}
+	p, q := elections.pubkeyObjects["1020"][0]["p"], elections.pubkeyObjects["1020"][0]["q"]
+
+	// agrees with euler's criterion
+	for i := 0; i < 50; i++ {
+		value, _ := rand.Int(rand.Reader, p)
+		euler := value.Sign() > 0 && new(big.Int).Exp(value, q, p).Cmp(big.NewInt(1)) == 0
+		if quadraticResidue(value, p) != euler {
+			t.Fatalf("Residue checks disagree for %v", value)
+		}
+	}
+
+	// p = 3 mod 4, so -1 is a non-residue
+	for _, value := range []*big.Int{big.NewInt(0), big.NewInt(-4), new(big.Int).Sub(p, big.NewInt(1)), p, new(big.Int).Add(p, big.NewInt(4))} {
+		if quadraticResidue(value, p) {
+			t.Fatalf("Value accepted as residue %v", value)
+		}
+	}
+	four := big.NewInt(4)
+	if !quadraticResidue(four, p) || four.Cmp(big.NewInt(4)) != 0 || p.Cmp(elections.pubkeyObjects["1020"][0]["p"]) != 0 {
+		t.Fatalf("Residue rejected or arguments modified")
+	}
+}
+
+// RFC 3526 4096-bit MODP group, a safe prime with generator 2 of the order q
+// subgroup, used to benchmark proof verification with larger keys
+const rfc3526Prime4096 = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74" +
+	"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437" +
+	"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+	"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05" +
+	"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB" +
+	"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B" +
+	"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718" +
+	"3995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33" +
+	"A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7" +
+	"ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864" +
+	"D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E2" +
+	"08E24FA074E5AB3143DB5BFCE0FD108E4B82D120A92108011A723C12A787E6D7" +
+	"88719A10BDBA5B2699C327186AF4E23C1A946834B6150BDA2583E9CA2AD44CE8" +
+	"DBBBC2DB04DE8EF92E8EFC141FBECAA6287C59474E6BC05D99B2964FA090C3A2" +
+	"233BA186515BE7ED1F612970CEE2D7AFB81BDD762170481CD0069127D5B05AA9" +
+	"93B4EA988D8FDDC186FFB7DC90A6C08F4DF435C934063199FFFFFFFFFFFFFFFF"
+
+// testPopkChecks returns n proof equations for random ballots encrypted with
+// pk, the proof of the first ballot is made invalid if invalid is set
+func testPopkChecks(pk map[string]*big.Int, n int, invalid bool) []proofCheck {
+	p, q, g := pk["p"], pk["q"], pk["g"]
+	// full size randomness and a sha256 challenge, as in the ballots
+	bound := new(big.Int).Lsh(big.NewInt(1), 256)
+	checks := make([]proofCheck, n)
+	for i := range checks {
+		k, _ := rand.Int(rand.Reader, q)
+		w, _ := rand.Int(rand.Reader, q)
+		challenge, _ := rand.Int(rand.Reader, bound)
+		response := new(big.Int).Mul(challenge, k)
+		response.Add(response, w)
+		response.Mod(response, q)
+		if invalid && i == 0 {
+			response.Add(response, big.NewInt(1))
+		}
+		checks[i] = &popkCheck{
+			pk:         pk,
+			alpha:      new(big.Int).Exp(g, k, p),
+			commitment: new(big.Int).Exp(g, w, p),
+			challenge:  challenge,
+			response:   response,
+		}
+	}
+	return checks
+}
+
+func TestPopkVerifiers(t *testing.T) {
+	elections, err := loadElectionDir("../admin/elections", func(string, ...interface{}) {})
+	if err != nil {
+		t.Fatalf("Error loading elections %v", err)
+	}
+	pk := elections.pubkeyObjects["1020"][0]
+
+	for _, name := range []string{"sequential", "parallel", "batch"} {
+		verifier, err := newPopkVerifier(name, 0, 0)
+		if err != nil {
+			t.Fatalf("Error creating verifier %v", err)
+		}
+		if err = verifier.verify(testPopkChecks(pk, 3, false)); err != nil {
+			t.Fatalf("%s: valid proofs rejected %v", name, err)
+		}
+		if err = verifier.verify(testPopkChecks(pk, 3, true)); err != ErrPopkVerification {
+			t.Fatalf("%s: invalid proof accepted", name)
+		}
+		if b, ok := verifier.(*batchVerifier); ok {
+			b.stop()
+		}
+	}
+	if _, err := newPopkVerifier("bogus", 0, 0); err == nil {
+		t.Fatalf("Unknown verifier accepted")
+	}
+
+	// an invalid ballot fails the batch, the others are still accepted
+	verifier := newBatchVerifier(50*time.Millisecond, 100)
+	defer verifier.stop()
+	results := make([]error, 6)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = verifier.verify(testPopkChecks(pk, 3, i == 2))
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range results {
+		if (i == 2) != (err == ErrPopkVerification) {
+			t.Fatalf("Unexpected result for ballot %d: %v", i, err)
+		}
+	}
+
+	// values outside the subgroup, the batch must agree with the individual
+	// checks. Negating alpha and the commitment keeps the proof valid for an
+	// odd challenge
+	checks := testPopkChecks(pk, 2, false)
+	for checks[0].(*popkCheck).challenge.Bit(0) == 0 {
+		checks = testPopkChecks(pk, 2, false)
+	}
+	check := checks[0].(*popkCheck)
+	check.alpha.Sub(pk["p"], check.alpha)
+	check.commitment.Sub(pk["p"], check.commitment)
+	if !check.verify() || !batchVerify(checks) {
+		t.Fatalf("Negated proof with odd challenge should verify")
+	}
+	// but not negating only the commitment, even if the signs of two such
+	// proofs cancel out in the batch product
+	checks = testPopkChecks(pk, 2, false)
+	for _, check := range checks {
+		check.(*popkCheck).commitment.Sub(pk["p"], check.(*popkCheck).commitment)
+	}
+	if checks[0].verify() || batchVerify(checks) {
+		t.Fatalf("Proofs with negated commitments accepted")
+	}
+	if err = verifier.verify(checks); err != ErrPopkVerification {
+		t.Fatalf("Fallback accepted invalid proofs")
+	}
+}
+
+// a format accepting any ballot, registered for TestBallotFormats
+type testBallot struct {
+	A string `json:"a"`
+}
+
+func (b *testBallot) validate(electionPks []map[string]*big.Int, checkResidues bool, eCfg *electionCfg, verifier popkVerifier) error {
+	return nil
+}
+
+func (b *testBallot) Marshal() ([]byte, error) {
+	return json.Marshal(b)
+}
+
+func init() {
+	registerBallotFormat("test-vote-v1", func(data []byte) (ballot, error) {
+		b := &testBallot{}
+		return b, json.Unmarshal(data, b)
+	})
+}
+
+func TestBallotFormats(t *testing.T) {
+	vote := strings.Replace(voteJson, `\"`, `"`, -1)
+	if b, err := parseBallot([]byte(vote), nil); err != nil {
+		t.Fatalf("Default ballot format refused %v", err)
+	} else if _, ok := b.(*EncryptedVote); !ok {
+		t.Fatalf("Unexpected ballot type %T", b)
+	}
+
+	testVote := `{"a":"test-vote-v1"}`
+	if _, err := parseBallot([]byte(`{"a":"unknown-vote-v1"}`), nil); err != ErrUnknownBallotFormat {
+		t.Fatalf("Expected unknown ballot format, got %v", err)
+	}
+	if _, err := parseBallot([]byte(testVote), nil); err != ErrBallotFormatNotAccepted {
+		t.Fatalf("Expected ballot format not accepted, got %v", err)
+	}
+
+	var cfg map[string]*json.RawMessage
+	json.Unmarshal([]byte(`{"ballot_formats": ["test-vote-v1"]}`), &cfg)
+	eCfg, err := parseElectionCfg(cfg)
+	if err != nil {
+		t.Fatalf("Error parsing election config %v", err)
+	}
+	if _, err := parseBallot([]byte(vote), eCfg); err != ErrBallotFormatNotAccepted {
+		t.Fatalf("Default format accepted by an election not listing it, got %v", err)
+	}
+	v := &Vote{Vote: testVote, VoteHash: HashSha256(testVote)}
+	if err := v.validate(nil, true, eCfg, nil); err != nil {
+		t.Fatalf("Registered ballot format refused %v", err)
+	}
+
+	json.Unmarshal([]byte(`{"ballot_formats": ["encrypted-vote-v1", "unknown-vote-v1"]}`), &cfg)
+	if _, err := parseElectionCfg(cfg); err == nil {
+		t.Fatalf("Election config with an unknown ballot format accepted")
+	}
+}
+
+// testBasePoint returns k * G
+func testBasePoint(k *big.Int) *nistec.P256Point {
+	point, err := nistec.NewP256Point().ScalarBaseMult(scalarBytes(k))
+	if err != nil {
+		panic(err)
+	}
+	return point
+}
+
+// testECVote returns a P-256 ballot with one choice per pubkey, with an
+// invalid proof if invalid is set
+func testECVote(pks []*nistec.P256Point, invalid bool) *ECEncryptedVote {
+	vote := &ECEncryptedVote{
+		A:            ecBallotFormat,
+		ElectionHash: &ElectionHash{A: "hash/sha256/value"},
+		IssueDate:    "18/10/2026",
+	}
+	for i, pk := range pks {
+		k, _ := rand.Int(rand.Reader, ecOrder)
+		w, _ := rand.Int(rand.Reader, ecOrder)
+		alpha := testBasePoint(k)
+		// the plaintext is the point (i + 1) * G
+		beta, _ := nistec.NewP256Point().ScalarMult(pk, scalarBytes(k))
+		beta.Add(beta, testBasePoint(big.NewInt(int64(i+1))))
+		commitment := testBasePoint(w)
+
+		challenge := ecChallenge(alpha, commitment)
+		response := new(big.Int).Mul(challenge, k)
+		response.Add(response, w)
+		if invalid {
+			response.Add(response, big.NewInt(1))
+		}
+		response.Mod(response, ecOrder)
+
+		vote.Choices = append(vote.Choices, &ECChoice{Alpha: encodePoint(alpha), Beta: encodePoint(beta)})
+		vote.Proofs = append(vote.Proofs, &ECPopk{Challenge: challenge.Text(16), Commitment: encodePoint(commitment), Response: response.Text(16)})
+	}
+	return vote
+}
+
+func TestECBallot(t *testing.T) {
+	var (
+		points  []*nistec.P256Point
+		pkFile  []map[string]string
+		elGamal = func() []map[string]*big.Int {
+			elections, _ := loadElectionDir("../admin/elections", func(string, ...interface{}) {})
+			return elections.pubkeyObjects["1020"]
+		}()
+	)
+	for i := 0; i < 3; i++ {
+		x, _ := rand.Int(rand.Reader, ecOrder)
+		point := testBasePoint(x)
+		points = append(points, point)
+		data := point.Bytes()
+		pkFile = append(pkFile, map[string]string{"curve": "P-256", "x": new(big.Int).SetBytes(data[1:33]).String(), "y": new(big.Int).SetBytes(data[33:]).String()})
+	}
+	pkText, _ := json.Marshal(pkFile)
+	pks, diagnostics := parsePubkeys(string(pkText))
+	if diagnostics != nil {
+		t.Fatalf("Valid curve pubkeys refused %v", diagnostics)
+	}
+	eCfg := &electionCfg{BallotFormats: []string{ecBallotFormat}}
+
+	marshalled, _ := testECVote(points, false).Marshal()
+	vote := string(marshalled)
+	for _, name := range []string{"sequential", "parallel", "batch"} {
+		verifier, _ := newPopkVerifier(name, 0, 0)
+		v := &Vote{Vote: vote, VoteHash: HashSha256(vote)}
+		if err := v.validate(pks, true, eCfg, verifier); err != nil {
+			t.Fatalf("%s: valid P-256 ballot refused %v", name, err)
+		}
+		if b, ok := verifier.(*batchVerifier); ok {
+			b.stop()
+		}
+	}
+
+	v := &Vote{Vote: vote, VoteHash: HashSha256(vote)}
+	if err := v.validate(pks, true, nil, nil); err != ErrBallotFormatNotAccepted {
+		t.Fatalf("Expected ballot format not accepted, got %v", err)
+	}
+	if err := v.validate(elGamal, true, eCfg, nil); err != ErrInvalidPubkey {
+		t.Fatalf("Expected invalid pubkey with ElGamal pubkeys, got %v", err)
+	}
+	encryptedVote, _ := ParseEncryptedVote([]byte(strings.Replace(voteJson, `\"`, `"`, -1)))
+	if err := encryptedVote.validate(pks, false, nil, nil); err != ErrInvalidPubkey {
+		t.Fatalf("Expected invalid pubkey with curve pubkeys, got %v", err)
+	}
+
+	if err := testECVote(points, true).validate(pks, true, eCfg, nil); err != ErrPopkVerification {
+		t.Fatalf("Expected popk verification failure, got %v", err)
+	}
+	offCurve := testECVote(points, false)
+	data, _ := hex.DecodeString(offCurve.Choices[1].Beta)
+	for _, err := decodePoint(hex.EncodeToString(data)); err == nil; _, err = decodePoint(hex.EncodeToString(data)) {
+		data[len(data)-1]++
+	}
+	offCurve.Choices[1].Beta = hex.EncodeToString(data)
+	if err := offCurve.validate(pks, true, eCfg, nil); err != ErrInvalidPoint {
+		t.Fatalf("Expected invalid point, got %v", err)
+	}
+	// the point at infinity and uncompressed points are refused
+	for _, encoded := range []string{"00", hex.EncodeToString(points[0].Bytes())} {
+		infinity := testECVote(points, false)
+		infinity.Choices[0].Alpha = encoded
+		if err := infinity.validate(pks, true, eCfg, nil); err != ErrInvalidPoint {
+			t.Fatalf("Expected invalid point for %s, got %v", encoded, err)
+		}
+	}
+
+	y, _ := new(big.Int).SetString(pkFile[2]["y"], 10)
+	pkFile[2]["y"] = y.Add(y, big.NewInt(1)).String()
+	pkText, _ = json.Marshal(pkFile)
+	if _, diagnostics = parsePubkeys(string(pkText)); len(diagnostics) != 1 {
+		t.Fatalf("Curve pubkey off the curve accepted")
+	}
+}
+
+// testRangeProof proves that (alpha, beta) = (g^k, g^m * y^k) encrypts one of
+// values, m must be one of them unless the proof is meant to be invalid
+func testRangeProof(pk map[string]*big.Int, alpha *big.Int, beta *big.Int, k *big.Int, m int, values []int) *RangeProof {
+	p, q, g, y := pk["p"], pk["q"], pk["g"], pk["y"]
+	commitments := make([][2]*big.Int, len(values))
+	challenges := make([]*big.Int, len(values))
+	responses := make([]*big.Int, len(values))
+
+	// simulated proofs for the other values
+	real := -1
+	w, _ := rand.Int(rand.Reader, q)
+	sum := new(big.Int)
+	for j, value := range values {
+		if value == m && real == -1 {
+			real = j
+			commitments[j] = [2]*big.Int{new(big.Int).Exp(g, w, p), new(big.Int).Exp(y, w, p)}
+			continue
+		}
+		challenges[j], _ = rand.Int(rand.Reader, q)
+		responses[j], _ = rand.Int(rand.Reader, q)
+		sum.Add(sum, challenges[j])
+		minusChallenge := new(big.Int).Sub(q, challenges[j])
+
+		a := new(big.Int).Exp(alpha, minusChallenge, p)
+		a.Mul(a, new(big.Int).Exp(g, responses[j], p)).Mod(a, p)
+		gm := new(big.Int).Exp(g, big.NewInt(int64(value)), p)
+		b := new(big.Int).Mul(beta, gm.ModInverse(gm, p))
+		b.Exp(b.Mod(b, p), minusChallenge, p)
+		b.Mul(b, new(big.Int).Exp(y, responses[j], p)).Mod(b, p)
+		commitments[j] = [2]*big.Int{a, b}
+	}
+	if real == -1 {
+		// m is not allowed, make the first proof inconsistent
+		real = 0
+		commitments[0] = [2]*big.Int{new(big.Int).Exp(g, w, p), new(big.Int).Exp(y, w, p)}
+		sum.Sub(sum, challenges[0])
+	}
+	challenge := rangeChallenge(pk, values, alpha, beta, commitments)
+	challenges[real] = challenge.Sub(challenge, sum).Mod(challenge, q)
+	responses[real] = new(big.Int).Mul(challenges[real], k)
+	responses[real].Add(responses[real], w).Mod(responses[real], q)
+
+	proof := &RangeProof{}
+	for j := range values {
+		proof.Commitments = append(proof.Commitments, &RangeCommitment{A: commitments[j][0].String(), B: commitments[j][1].String()})
+		proof.Challenges = append(proof.Challenges, challenges[j].String())
+		proof.Responses = append(proof.Responses, responses[j].String())
+	}
+	return proof
+}
+
+func TestRangeChallenge(t *testing.T) {
+	// only hashed, a large q keeps the challenges of different statements apart
+	pk := map[string]*big.Int{"p": big.NewInt(4611686018427387903), "q": big.NewInt(2305843009213693951), "g": big.NewInt(4), "y": big.NewInt(8)}
+	commitments := [][2]*big.Int{{big.NewInt(2), big.NewInt(3)}, {big.NewInt(6), big.NewInt(9)}}
+	challenge := rangeChallenge(pk, []int{0, 1}, big.NewInt(4), big.NewInt(12), commitments)
+
+	// every part of the statement changes the challenge
+	for name, other := range map[string]*big.Int{
+		"p":      rangeChallenge(map[string]*big.Int{"p": big.NewInt(47), "q": pk["q"], "g": pk["g"], "y": pk["y"]}, []int{0, 1}, big.NewInt(4), big.NewInt(12), commitments),
+		"q":      rangeChallenge(map[string]*big.Int{"p": pk["p"], "q": big.NewInt(2305843009213693921), "g": pk["g"], "y": pk["y"]}, []int{0, 1}, big.NewInt(4), big.NewInt(12), commitments),
+		"g":      rangeChallenge(map[string]*big.Int{"p": pk["p"], "q": pk["q"], "g": big.NewInt(9), "y": pk["y"]}, []int{0, 1}, big.NewInt(4), big.NewInt(12), commitments),
+		"y":      rangeChallenge(map[string]*big.Int{"p": pk["p"], "q": pk["q"], "g": pk["g"], "y": big.NewInt(9)}, []int{0, 1}, big.NewInt(4), big.NewInt(12), commitments),
+		"values": rangeChallenge(pk, []int{1, 2}, big.NewInt(4), big.NewInt(12), commitments),
+		"alpha":  rangeChallenge(pk, []int{0, 1}, big.NewInt(6), big.NewInt(12), commitments),
+		"beta":   rangeChallenge(pk, []int{0, 1}, big.NewInt(4), big.NewInt(13), commitments),
+	} {
+		if other.Cmp(challenge) == 0 {
+			t.Fatalf("The challenge doesn't depend on %s", name)
+		}
+	}
+}
+
+// testVoteV2 encrypts the given selections, one slice of 0 or 1 per question,
+// claiming that the number of selections of each question is in [min, max]
+func testVoteV2(pks []map[string]*big.Int, questions []*questionCfg, selections [][]int) *EncryptedVoteV2 {
+	vote := &EncryptedVoteV2{
+		A:            rangeBallotFormat,
+		ElectionHash: &ElectionHash{A: "hash/sha256/value"},
+		IssueDate:    "18/10/2026",
+	}
+	for index, pk := range pks {
+		p, q, g, y := pk["p"], pk["q"], pk["g"], pk["y"]
+		choice := &ChoiceV2{}
+		proof := &QuestionProof{}
+		sumAlpha, sumBeta, sumK := big.NewInt(1), big.NewInt(1), new(big.Int)
+		selected := 0
+		for _, m := range selections[index] {
+			k, _ := rand.Int(rand.Reader, q)
+			alpha := new(big.Int).Exp(g, k, p)
+			beta := new(big.Int).Exp(y, k, p)
+			beta.Mul(beta, new(big.Int).Exp(g, big.NewInt(int64(m)), p)).Mod(beta, p)
+			choice.Selections = append(choice.Selections, &Choice{AlphaString: alpha.String(), BetaString: beta.String()})
+			proof.Selections = append(proof.Selections, testRangeProof(pk, alpha, beta, k, m, []int{0, 1}))
+
+			sumAlpha.Mul(sumAlpha, alpha).Mod(sumAlpha, p)
+			sumBeta.Mul(sumBeta, beta).Mod(sumBeta, p)
+			sumK.Add(sumK, k)
+			selected += m
+		}
+		proof.Sum = testRangeProof(pk, sumAlpha, sumBeta, sumK.Mod(sumK, q), selected, questions[index].selectionRange())
+		vote.Choices = append(vote.Choices, choice)
+		vote.Proofs = append(vote.Proofs, proof)
+	}
+	return vote
+}
+
+func TestRangeBallot(t *testing.T) {
+	elections, err := loadElectionDir("../admin/elections", func(string, ...interface{}) {})
+	if err != nil {
+		t.Fatalf("Error loading elections %v", err)
+	}
+	pks := elections.pubkeyObjects["1020"]
+	questions := elections.electionCfgs["1020"].Questions
+	if len(questions) != 3 || questions[0].Min != 0 || questions[0].Max != 1 || questions[0].NumAnswers != 2 {
+		t.Fatalf("Unexpected questions for 1020 %v", questions)
+	}
+
+	// smaller questions than those of 1020 to keep the test fast
+	eCfg := &electionCfg{
+		NumQuestions:  3,
+		Questions:     []*questionCfg{{Min: 0, Max: 1, NumAnswers: 2}, {Min: 1, Max: 2, NumAnswers: 3}, {Min: 0, Max: 5, NumAnswers: 1}},
+		BallotFormats: []string{rangeBallotFormat},
+	}
+	valid := testVoteV2(pks, eCfg.Questions, [][]int{{0, 1}, {1, 0, 1}, {0}})
+	marshalled, _ := valid.Marshal()
+	v := &Vote{Vote: string(marshalled), VoteHash: HashSha256(string(marshalled))}
+	if err = v.validate(pks, true, eCfg, parallelVerifier{}); err != nil {
+		t.Fatalf("Valid v2 ballot refused %v", err)
+	}
+	if err = v.validate(pks, true, nil, nil); err != ErrBallotFormatNotAccepted {
+		t.Fatalf("Expected ballot format not accepted, got %v", err)
+	}
+	if err = valid.validate(pks, true, &electionCfg{}, nil); err != ErrMissingQuestions {
+		t.Fatalf("Expected missing questions, got %v", err)
+	}
+
+	// a selection that isn't 0 or 1
+	if err = testVoteV2(pks, eCfg.Questions, [][]int{{0, 2}, {1, 0, 1}, {0}}).validate(pks, true, eCfg, nil); err != ErrPopkVerification {
+		t.Fatalf("Selection out of range accepted %v", err)
+	}
+	// too many and too few selections for question 1
+	if err = testVoteV2(pks, eCfg.Questions, [][]int{{0, 1}, {1, 1, 1}, {0}}).validate(pks, true, eCfg, nil); err != ErrPopkVerification {
+		t.Fatalf("Selections over max accepted %v", err)
+	}
+	if err = testVoteV2(pks, eCfg.Questions, [][]int{{0, 1}, {0, 0, 0}, {0}}).validate(pks, true, eCfg, nil); err != ErrPopkVerification {
+		t.Fatalf("Selections under min accepted %v", err)
+	}
+	// sum proof made for a wider range than the question allows
+	wide := testVoteV2(pks, []*questionCfg{{Min: 0, Max: 2, NumAnswers: 2}, eCfg.Questions[1], eCfg.Questions[2]}, [][]int{{1, 1}, {1, 0, 1}, {0}})
+	if err = wide.validate(pks, true, eCfg, nil); err == nil {
+		t.Fatalf("Sum proof for the wrong range accepted")
+	}
+
+	if err = testVoteV2(pks, eCfg.Questions, [][]int{{0, 1, 0}, {1, 0, 1}, {0}}).validate(pks, true, eCfg, nil); err != ErrInvalidSelectionsCount {
+		t.Fatalf("Expected invalid selections count, got %v", err)
+	}
+	tampered := testVoteV2(pks, eCfg.Questions, [][]int{{0, 1}, {1, 0, 1}, {0}})
+	tampered.Proofs[1].Selections[2].Challenges[0] = "1"
+	if err = tampered.validate(pks, true, eCfg, nil); err != ErrPopkVerification {
+		t.Fatalf("Tampered challenge accepted %v", err)
+	}
+	tampered.Proofs[1].Selections = tampered.Proofs[1].Selections[:2]
+	if err = tampered.validate(pks, true, eCfg, nil); err != ErrInvalidProofsCount {
+		t.Fatalf("Expected invalid proofs count, got %v", err)
+	}
+}
+
+func TestBallotBoxElectionState(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+
+	openElection(tb, "1020")
+	state := tb.RequestJson("GET", "/api/v1/ballotbox/election/1020/state", http.StatusOK, adminHeaders(), "")
+	if state.(map[string]interface{})["state"] != StateOpen {
+		t.Fatalf("Election should be open, got %v", state)
+	}
+	tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/state/keys-ready", http.StatusBadRequest, adminHeaders(), "")
+
+	tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/state/paused", http.StatusOK, adminHeaders(), "")
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusForbidden, "election-paused", voterHeaders("1020", "1"), newVoteJson)
+	openElection(tb, "1020")
+	tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusAccepted, voterHeaders("1020", "1"), newVoteJson)
+}
+
+func TestVotingWindow(t *testing.T) {
+	var cfg map[string]*json.RawMessage
+	json.Unmarshal([]byte(`{"voting_start_date": "2013-12-06T18:17:14.457000", "voting_end_date": "2013-12-09T18:17:14.457000"}`), &cfg)
+	eCfg, err := parseElectionCfg(cfg)
+	if err != nil {
+		t.Fatalf("Error parsing voting dates: %v", err)
+	}
+	if !eCfg.VotingStartDate.Equal(time.Date(2013, 12, 6, 18, 17, 14, 457000000, time.UTC)) {
+		t.Fatalf("Unexpected voting start date %v", eCfg.VotingStartDate)
+	}
+	skew := time.Minute
+
+	if err := eCfg.checkVotingWindow(electionOpen, skew); err != nil {
+		t.Fatalf("Vote rejected inside the voting window: %v", err)
+	}
+	if err := eCfg.checkVotingWindow(eCfg.VotingStartDate.Add(-2*time.Minute), skew); err != ErrElectionNotOpen {
+		t.Fatalf("Expected election not open, got %v", err)
+	}
+	if err := eCfg.checkVotingWindow(eCfg.VotingStartDate.Add(-30*time.Second), skew); err != nil {
+		t.Fatalf("Vote rejected within the clock skew: %v", err)
+	}
+	if err := eCfg.checkVotingWindow(eCfg.VotingEndDate.Add(30*time.Second), skew); err != nil {
+		t.Fatalf("Vote rejected within the clock skew: %v", err)
+	}
+	if err := eCfg.checkVotingWindow(eCfg.VotingEndDate.Add(2*time.Minute), skew); err != ErrElectionClosed {
+		t.Fatalf("Expected election closed, got %v", err)
+	}
+	if err := (&electionCfg{}).checkVotingWindow(time.Now(), 0); err != nil {
+		t.Fatalf("Vote rejected with no voting window: %v", err)
+	}
+}
+
+func TestBallotBoxVotingWindow(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+	openElection(tb, "1020")
+
+	tb.clock = func() time.Time { return time.Date(2013, 12, 1, 0, 0, 0, 0, time.UTC) }
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusForbidden, "election-not-open", voterHeaders("1020", "1"), newVoteJson)
+
+	tb.clock = func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusForbidden, "election-closed", voterHeaders("1020", "1"), newVoteJson)
+}
+
+// checks the receipt of an accepted vote against the published signing key
+func checkReceipt(t *testing.T, tb *testBallotBox, posted interface{}, writeCount int64) {
+	var key map[string]string
+	if err := json.Unmarshal(tb.Request("GET", "/api/v1/ballotbox/signing-key", http.StatusOK, nil, ""), &key); err != nil {
+		t.Fatalf("Error parsing signing key %v", err)
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(key["public_key"])
+	if err != nil {
+		t.Fatalf("Error decoding signing key %v", err)
+	}
+
+	// round trip through json to get a Receipt
+	b, _ := json.Marshal(posted.(map[string]interface{})["receipt"])
+	var receipt Receipt
+	if err := json.Unmarshal(b, &receipt); err != nil {
+		t.Fatalf("Error parsing receipt %v", err)
+	}
+	if receipt.ElectionId != "1020" || receipt.VoteHash != newVoteHash || receipt.WriteCount != writeCount {
+		t.Fatalf("Unexpected receipt %v", receipt)
+	}
+	if !VerifyReceipt(ed25519.PublicKey(publicKey), &receipt) {
+		t.Fatalf("Invalid receipt signature")
+	}
+	receipt.WriteCount++
+	if VerifyReceipt(ed25519.PublicKey(publicKey), &receipt) {
+		t.Fatalf("Tampered receipt verified")
+	}
+}
+
+// testBallotBox serves a BallotBox module with a memory vote store and a
+// temporary election dir, without the agora-http-go server, so no database
+// is needed. Routes check their permissions like in Init, and handler errors
+// are returned as {"error": <coded message>}
+type testBallotBox struct {
+	*BallotBox
+	t           *testing.T
+	server      *httptest.Server
+	electionDir string
+}
+
+const testBallotBoxConfig = `{
+	"maxWrites": 2,
+	"electionDir": %q,
+	"checkResidues": true,
+	"implicitOpen": false,
+	"temporarySigningKey": true,
+	"legacyVoterSecret": true,
+	"voteStore": "memory"
+}`
+
+// newTestBallotBox starts a module with the test election 1020, at a time
+// when its voting window is open
+func newTestBallotBox(t *testing.T) *testBallotBox {
+	if s.Server.Logger == nil {
+		s.Server.Logger = log.New(ioutil.Discard, "", 0)
+	}
+	s.Server.SharedSecret = SharedSecret
+	tb := &testBallotBox{
+		BallotBox:   &BallotBox{clock: func() time.Time { return electionOpen }},
+		t:           t,
+		electionDir: t.TempDir(),
+	}
+	for _, name := range []string{"config.json", "pk_1020"} {
+		data, err := ioutil.ReadFile(path.Join("../admin/elections/1020", name))
+		if err != nil {
+			t.Fatalf("Error reading test election %v", err)
+		}
+		tb.writeElectionFile("1020", name, string(data))
+	}
+
+	var cfg map[string]*json.RawMessage
+	if err := json.Unmarshal([]byte(fmt.Sprintf(testBallotBoxConfig, tb.electionDir)), &cfg); err != nil {
+		t.Fatalf("Error parsing config %v", err)
+	}
+	if err := tb.configure(cfg); err != nil {
+		t.Fatalf("Error configuring the ballotbox %v", err)
+	}
+
+	router := httprouter.New()
+	for _, r := range tb.routes() {
+		handler := tb.authHandler(r)
+		router.Handle(r.method, r.path, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			if hErr := handler(w, r, p); hErr != nil {
+				writeJson(w, hErr.Code, map[string]string{"error": hErr.CodedMessage})
+			}
+		})
+	}
+	tb.server = httptest.NewServer(http.StripPrefix("/api/v1/ballotbox", router))
+	return tb
+}
+
+func (tb *testBallotBox) TearDown() {
+	tb.server.Close()
+}
+
+// writeElectionFile adds a file to the election dir, picked up on reload
+func (tb *testBallotBox) writeElectionFile(dir string, name string, contents string) {
+	if err := os.MkdirAll(path.Join(tb.electionDir, dir), 0755); err != nil {
+		tb.t.Fatalf("Error creating election dir %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(tb.electionDir, dir, name), []byte(contents), 0644); err != nil {
+		tb.t.Fatalf("Error writing election file %v", err)
+	}
+}
+
+// Request sends a request and checks the response status code
+func (tb *testBallotBox) Request(method string, path string, code int, headers map[string]string, body string) []byte {
+	req, err := http.NewRequest(method, tb.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		tb.t.Fatalf("Error creating request %v", err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		tb.t.Fatalf("Error sending request %v", err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		tb.t.Fatalf("Error reading response %v", err)
+	}
+	if res.StatusCode != code {
+		tb.t.Fatalf("%s %s: expected status %d, got %d %s", method, path, code, res.StatusCode, b)
+	}
+	return b
+}
+
+func (tb *testBallotBox) RequestJson(method string, path string, code int, headers map[string]string, body string) interface{} {
+	var ret interface{}
+	if err := json.Unmarshal(tb.Request(method, path, code, headers, body), &ret); err != nil {
+		tb.t.Fatalf("%s %s: error decoding response %v", method, path, err)
+	}
+	return ret
+}
+
+// RequestError sends a request that must fail with the given status code and
+// coded message
+func (tb *testBallotBox) RequestError(method string, path string, code int, codedMessage string, headers map[string]string, body string) {
+	ret := tb.RequestJson(method, path, code, headers, body).(map[string]interface{})
+	if ret["error"] != codedMessage {
+		tb.t.Fatalf("%s %s: expected error %s, got %v", method, path, codedMessage, ret)
+	}
+}
+
+// voterHeaders returns the Authorization header of a voter, signed with the
+// SharedSecret as the test elections have no secrets file
+func voterHeaders(electionId string, voterId string) map[string]string {
+	return map[string]string{"Authorization": middleware.AuthHeader("voter-"+electionId+"-"+voterId, SharedSecret)}
+}
+
+// adminHeaders returns the Authorization header of a global admin
+func adminHeaders() map[string]string {
+	return map[string]string{"Authorization": AdminAuthHeader(PermGlobalAdmin, "test@example.com", SharedSecret)}
+}
+
+// voteRequest returns the body posting vote
+func voteRequest(vote string) string {
+	b, _ := json.Marshal(map[string]string{"vote": vote, "vote_hash": HashSha256(vote)})
+	return string(b)
+}
+
+func TestBallotBoxApi(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+	openElection(tb, "1020")
+
+	posted := tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusAccepted, voterHeaders("1020", "1"), newVoteJson)
+	checkReceipt(t, tb, posted, 1)
+	posted = tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusAccepted, voterHeaders("1020", "1"), newVoteJson)
+	checkReceipt(t, tb, posted, 2)
+
+	// maxWrites is 2
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusForbidden, "revote-not-allowed", voterHeaders("1020", "1"), newVoteJson)
+
+	found := tb.RequestJson("GET", fmt.Sprintf("/api/v1/ballotbox/election/1020/check-hash/1/%s", newVoteHash), http.StatusOK, voterHeaders("1020", "1"), "")
+	if found.(map[string]interface{})["vote_hash"] != newVoteHash {
+		t.Fatalf("Unexpected found vote %v", found)
+	}
+	tb.RequestError("GET", fmt.Sprintf("/api/v1/ballotbox/election/1020/check-hash/1/%s", HashSha256("bogus")), http.StatusNotFound, "not-found", voterHeaders("1020", "1"), "")
+
+	config := tb.Request("GET", "/api/v1/ballotbox/election/1020/config", http.StatusOK, nil, "")
+	if string(config) != tb.configs["1020"] {
+		t.Fatalf("Unexpected election config")
+	}
+
+	// voter and admin routes need their token
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusForbidden, "invalid-auth", nil, newVoteJson)
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/vote/2", http.StatusForbidden, "invalid-auth", voterHeaders("1020", "1"), newVoteJson)
+	tb.RequestError("GET", fmt.Sprintf("/api/v1/ballotbox/election/1020/check-hash/2/%s", newVoteHash), http.StatusForbidden, "invalid-auth", voterHeaders("1020", "1"), "")
+	tb.RequestError("GET", "/api/v1/ballotbox/election/1020/state", http.StatusForbidden, "invalid-auth", nil, "")
+	tb.RequestError("GET", "/api/v1/ballotbox/election/1020/state", http.StatusForbidden, "invalid-auth", voterHeaders("1020", "1"), "")
+	tb.RequestError("POST", "/api/v1/ballotbox/reload-config", http.StatusForbidden, "permission-denied",
+		map[string]string{"Authorization": AdminAuthHeader("admin-1020-write", "test@example.com", SharedSecret)}, "{}")
+}
+
+func TestBallotBoxVoterHistory(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+	openElection(tb, "1020")
+	tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusAccepted, voterHeaders("1020", "1"), newVoteJson)
+
+	// re-cast a different ballot, the first one stays in the history
+	var ballot map[string]interface{}
+	json.Unmarshal([]byte(strings.Replace(voteJson, `\"`, `"`, -1)), &ballot)
+	ballot["issue_date"] = "08/11/2014"
+	b, _ := json.Marshal(ballot)
+	tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusAccepted, voterHeaders("1020", "1"), voteRequest(string(b)))
+
+	history := tb.RequestJson("GET", "/api/v1/ballotbox/election/1020/voter/1/history", http.StatusOK, adminHeaders(), "").(map[string]interface{})
+	casts := history["casts"].([]interface{})
+	if len(casts) != 2 {
+		t.Fatalf("Unexpected history %v", history)
+	}
+	first, second := casts[0].(map[string]interface{}), casts[1].(map[string]interface{})
+	if first["vote_hash"] != newVoteHash || first["write_count"] != 1.0 || second["vote_hash"] != HashSha256(string(b)) || second["write_count"] != 2.0 {
+		t.Fatalf("Unexpected casts %v", casts)
+	}
+	if first["vote"] != nil {
+		t.Fatalf("Ciphertexts included without being requested")
+	}
+
+	history = tb.RequestJson("GET", "/api/v1/ballotbox/election/1020/voter/1/history?ciphertexts=true", http.StatusOK, adminHeaders(), "").(map[string]interface{})
+	if history["casts"].([]interface{})[1].(map[string]interface{})["vote"] != string(b) {
+		t.Fatalf("Unexpected history %v", history)
+	}
+	history = tb.RequestJson("GET", "/api/v1/ballotbox/election/1020/voter/2/history", http.StatusOK, adminHeaders(), "").(map[string]interface{})
+	if len(history["casts"].([]interface{})) != 0 {
+		t.Fatalf("Unexpected history %v", history)
+	}
+	tb.RequestError("GET", "/api/v1/ballotbox/election/bogus/voter/1/history", http.StatusNotFound, "election-not-found", adminHeaders(), "")
+}
+
+func TestRevotePolicy(t *testing.T) {
+	parse := func(policy string) (*electionCfg, error) {
+		var cfg map[string]*json.RawMessage
+		json.Unmarshal([]byte(`{"revote_policy": `+policy+`}`), &cfg)
+		return parseElectionCfg(cfg)
+	}
+	policies := map[string]CastLimits{
+		`{"mode": "single-cast", "max_writes": 5}`:       {MaxWrites: 1},
+		`{"mode": "last-vote-counts"}`:                   {MaxWrites: 10},
+		`{"mode": "last-vote-counts", "max_writes": 3}`:  {MaxWrites: 3},
+		`{"mode": "first-vote-counts"}`:                  {MaxWrites: 10, KeepFirst: true},
+		`{"mode": "unlimited", "cooldown": 60}`:          {Cooldown: time.Minute},
+	}
+	for policy, expected := range policies {
+		eCfg, err := parse(policy)
+		if err != nil {
+			t.Fatalf("Error parsing %s: %v", policy, err)
+		}
+		if limits := eCfg.castLimits(10); limits != expected {
+			t.Fatalf("Unexpected limits for %s: %v", policy, limits)
+		}
+	}
+	if limits := (&electionCfg{}).castLimits(10); limits != (CastLimits{MaxWrites: 10}) {
+		t.Fatalf("Unexpected default limits %v", limits)
+	}
+	for _, policy := range []string{`{"mode": "bogus"}`, `{"mode": "unlimited", "cooldown": -1}`, `"single-cast"`} {
+		if _, err := parse(policy); err == nil {
+			t.Fatalf("Invalid policy %s accepted", policy)
+		}
+	}
+}
+
+func TestBallotBoxRevotePolicy(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+	otherVote := func(issueDate string) string {
+		var ballot map[string]interface{}
+		json.Unmarshal([]byte(strings.Replace(voteJson, `\"`, `"`, -1)), &ballot)
+		ballot["issue_date"] = issueDate
+		b, _ := json.Marshal(ballot)
+		return string(b)
+	}
+	setPolicy := func(policy string) {
+		var cfg map[string]interface{}
+		json.Unmarshal([]byte(tb.configs["1020"]), &cfg)
+		var value interface{}
+		json.Unmarshal([]byte(policy), &value)
+		cfg["revote_policy"] = value
+		b, _ := json.Marshal(cfg)
+		tb.writeElectionFile("1020", "config.json", string(b))
+		tb.RequestJson("POST", "/api/v1/ballotbox/reload-config", http.StatusAccepted, adminHeaders(), "{}")
+	}
+	openElection(tb, "1020")
 
-	posted := ts.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusAccepted, voteAuth, newVoteJson)
-	fmt.Printf("new vote %v\n", posted)
-	posted = ts.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusAccepted, voteAuth, newVoteJson)
-	fmt.Printf("new vote %v\n", posted)
+	setPolicy(`{"mode": "single-cast"}`)
+	tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusAccepted, voterHeaders("1020", "1"), newVoteJson)
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusForbidden, "revote-not-allowed", voterHeaders("1020", "1"), voteRequest(otherVote("08/11/2014")))
 
-	foundVote := ts.Request("GET", fmt.Sprintf("/api/v1/ballotbox/election/1020/check-hash/1/%s", newVoteHash), http.StatusOK, voteAuth, "")
-	fmt.Printf("found vote %v\n", foundVote)
+	setPolicy(`{"mode": "unlimited", "cooldown": 3600}`)
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusTooManyRequests, "revote-cooldown", voterHeaders("1020", "1"), voteRequest(otherVote("08/11/2014")))
 
-    // will only work if there is an election (config.json) with election-id 1020 in admin/elections
-    ts.Request("GET", "/api/v1/ballotbox/election/1020/config/1", http.StatusOK, voteAuth, "")
+	setPolicy(`{"mode": "first-vote-counts"}`)
+	posted := tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusAccepted, voterHeaders("1020", "1"), voteRequest(otherVote("08/11/2014"))).(map[string]interface{})
+	if posted["updated"] != "false" || posted["recorded"] != "true" || posted["receipt"] != nil {
+		t.Fatalf("Unexpected first-vote-counts re-cast %v", posted)
+	}
+	tb.Request("GET", fmt.Sprintf("/api/v1/ballotbox/election/1020/check-hash/1/%s", newVoteHash), http.StatusOK, voterHeaders("1020", "1"), "")
 
-    ts.RequestJson("POST", "/api/v1/ballotbox/reload-config", http.StatusAccepted, adminAuth, "{}")
+	// a duplicate hash is still a plain refusal
+	posted = tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/2", http.StatusAccepted, voterHeaders("1020", "2"), newVoteJson).(map[string]interface{})
+	if posted["updated"] != "false" || posted["recorded"] != nil {
+		t.Fatalf("Unexpected duplicate hash cast %v", posted)
+	}
 }
 
-func TestAgoraApiDuplicateHash(t *testing.T) {
-	ts := stest.New(t, Config)
-	defer ts.TearDown()
-	voteAuth := map[string]string{"Authorization": middleware.AuthHeader("voter-1020-1", SharedSecret)}
-	voteAuth2 := map[string]string{"Authorization": middleware.AuthHeader("voter-1020-2", SharedSecret)}
+func TestBallotBoxDuplicateHash(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+	openElection(tb, "1020")
+	tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusAccepted, voterHeaders("1020", "1"), newVoteJson)
 
-	// Adding a new vote with other user and the same hash
-	// This shouldn't add nothing to the database because the duplicate hash
-	// The updated return will be false because nothing changes
-	posted := ts.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/2", http.StatusAccepted, voteAuth2, newVoteJson)
-	fmt.Printf("new vote %v\n", posted)
-	p := posted.(map[string]interface{})
-	if p["updated"] == "true" {
-		t.Fatalf("A row has been updated and shouldn't because the duplicate hash")
+	// the same ballot from another voter is not stored
+	posted := tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/2", http.StatusAccepted, voterHeaders("1020", "2"), newVoteJson)
+	if p := posted.(map[string]interface{}); p["updated"] != "false" {
+		t.Fatalf("Duplicate hash stored %v", p)
 	}
 
-	foundVote := ts.Request("GET", fmt.Sprintf("/api/v1/ballotbox/election/1020/check-hash/1/%s", newVoteHash), http.StatusOK, voteAuth, "")
-	fmt.Printf("found vote %v\n", foundVote)
-	foundVote = ts.Request("GET", fmt.Sprintf("/api/v1/ballotbox/election/1020/check-hash/2/%s", newVoteHash), http.StatusNotFound, voteAuth2, "")
-	fmt.Printf("found vote %v\n", foundVote)
+	tb.Request("GET", fmt.Sprintf("/api/v1/ballotbox/election/1020/check-hash/1/%s", newVoteHash), http.StatusOK, voterHeaders("1020", "1"), "")
+	tb.RequestError("GET", fmt.Sprintf("/api/v1/ballotbox/election/1020/check-hash/2/%s", newVoteHash), http.StatusNotFound, "not-found", voterHeaders("1020", "2"), "")
+	board := tb.RequestJson("GET", "/api/v1/ballotbox/election/1020/bulletin-board", http.StatusOK, nil, "").(map[string]interface{})
+	if len(board["ballots"].([]interface{})) != 1 {
+		t.Fatalf("Unexpected bulletin board %v", board)
+	}
+}
+
+func TestBallotBoxInvalidVotes(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+	vote := strings.Replace(voteJson, `\"`, `"`, -1)
+
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusForbidden, "election-not-open", voterHeaders("1020", "1"), newVoteJson)
+	openElection(tb, "1020")
+
+	tb.RequestError("POST", "/api/v1/ballotbox/election/bogus/vote/1", http.StatusNotFound, "election-not-found", voterHeaders("bogus", "1"), newVoteJson)
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusBadRequest, "invalid-json", voterHeaders("1020", "1"), "not json")
+
+	// a proof response off by one fails verification
+	response := "21709072417461931213953125316083694569255580351730652272998161309447698958876"
+	invalidProof := strings.Replace(vote, response, response[:len(response)-1]+"7", 1)
+	if invalidProof == vote {
+		t.Fatalf("Proof response not found in the test vote")
+	}
+	tb.Request("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusBadRequest, voterHeaders("1020", "1"), voteRequest(invalidProof))
+
+	// one choice less
+	var ballot map[string]interface{}
+	json.Unmarshal([]byte(vote), &ballot)
+	ballot["choices"] = ballot["choices"].([]interface{})[1:]
+	b, _ := json.Marshal(ballot)
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusBadRequest, ErrInvalidChoicesCount.Code, voterHeaders("1020", "1"), voteRequest(string(b)))
+
+	// the hash must match the ballot
+	tb.Request("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusBadRequest, voterHeaders("1020", "1"),
+		strings.Replace(voteRequest(vote), newVoteHash, HashSha256("bogus"), 1))
+
+	if count, _ := tb.store.CountVotes("1020"); count != 0 {
+		t.Fatalf("Invalid votes stored: %d", count)
+	}
+}
+
+func TestBallotBoxReloadConfig(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+	adminAuth := map[string]string{"Authorization": middleware.AuthHeader("admin", SharedSecret)}
+	tb.RequestError("GET", "/api/v1/ballotbox/election/1021/config", http.StatusNotFound, "not-found", nil, "")
+
+	tb.writeElectionFile("1021", "config.json", tb.configs["1020"])
+	tb.writeElectionFile("1021", "pk_1021", tb.pubkeys["1020"])
+	tb.writeElectionFile("1022", "config.json", tb.configs["1020"])
+	tb.writeElectionFile("1022", "pk_1022", "[]")
+	// broken configs are reported too
+	tb.writeElectionFile("1023", "config.json", "{")
+	tb.writeElectionFile("1024", "config.json", `{"voting_start_date": "bogus"}`)
+
+	reloaded := tb.RequestJson("POST", "/api/v1/ballotbox/reload-config", http.StatusAccepted, adminAuth, "{}").(map[string]interface{})
+	errors := reloaded["errors"].(map[string]interface{})
+	if len(errors) != 3 || errors["1022"] == nil || errors["1023"] == nil || errors["1024"] == nil {
+		t.Fatalf("Unexpected load errors %v", errors)
+	}
+	tb.Request("GET", "/api/v1/ballotbox/election/1021/config", http.StatusOK, nil, "")
+	tb.Request("GET", "/api/v1/ballotbox/election/1021/pubkeys", http.StatusOK, nil, "")
+	tb.RequestError("GET", "/api/v1/ballotbox/election/1022/config", http.StatusNotFound, "not-found", nil, "")
+	state := tb.RequestJson("GET", "/api/v1/ballotbox/election/1021/state", http.StatusOK, adminAuth, "").(map[string]interface{})
+	if state["state"] != StateKeysReady {
+		t.Fatalf("Unexpected state of the reloaded election %v", state)
+	}
+}
+
+func TestBallotBoxCensus(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+	openElection(tb, "1020")
+
+	// without census any voter is accepted
+	tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/3", http.StatusAccepted, voterHeaders("1020", "3"), newVoteJson)
+
+	tb.writeElectionFile("1020", "census_1020", "1\n\n3\n")
+	tb.RequestJson("POST", "/api/v1/ballotbox/reload-config", http.StatusAccepted, adminHeaders(), "{}")
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/vote/2", http.StatusForbidden, "voter-not-in-census", voterHeaders("1020", "2"), newVoteJson)
+
+	added := tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/census", http.StatusOK, adminHeaders(), `["2", "3"]`).(map[string]interface{})
+	if added["added"] != 1.0 {
+		t.Fatalf("Unexpected census upload %v", added)
+	}
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/census", http.StatusBadRequest, "invalid-format", adminHeaders(), "[]")
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1021/census", http.StatusNotFound, "election-not-found", adminHeaders(), `["2"]`)
+	var ballot map[string]interface{}
+	json.Unmarshal([]byte(strings.Replace(voteJson, `\"`, `"`, -1)), &ballot)
+	ballot["issue_date"] = "08/11/2014"
+	b, _ := json.Marshal(ballot)
+	tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/2", http.StatusAccepted, voterHeaders("1020", "2"), voteRequest(string(b)))
+
+	report := tb.RequestJson("GET", "/api/v1/ballotbox/election/1020/census", http.StatusOK, adminHeaders(), "").(map[string]interface{})
+	if report["census_size"] != 3.0 || report["votes"] != 2.0 || report["turnout"] != 2.0/3.0 {
+		t.Fatalf("Unexpected census report %v", report)
+	}
+
+	tb.RequestJson("DELETE", "/api/v1/ballotbox/election/1020/census/1", http.StatusOK, adminHeaders(), "")
+	tb.RequestError("DELETE", "/api/v1/ballotbox/election/1020/census/1", http.StatusNotFound, "not-found", adminHeaders(), "")
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusForbidden, "voter-not-in-census", voterHeaders("1020", "1"), newVoteJson)
+
+	// an emptied census still rejects every voter after a reload
+	if err := os.Remove(path.Join(tb.electionDir, "1020", "census_1020")); err != nil {
+		t.Fatal(err)
+	}
+	tb.RequestJson("DELETE", "/api/v1/ballotbox/election/1020/census/2", http.StatusOK, adminHeaders(), "")
+	tb.RequestJson("DELETE", "/api/v1/ballotbox/election/1020/census/3", http.StatusOK, adminHeaders(), "")
+	tb.RequestJson("POST", "/api/v1/ballotbox/reload-config", http.StatusAccepted, adminHeaders(), "{}")
+	tb.RequestError("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusForbidden, "voter-not-in-census", voterHeaders("1020", "1"), newVoteJson)
+}
+
+func TestBallotBoxElectionSecrets(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+	handler := tb.voterAuth("voter-${election_id}-${voter_id}", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+		return nil
+	})
+	checkToken := func(token string, code string) {
+		r := httptest.NewRequest("POST", "/election/1020/vote/1", nil)
+		r.Header.Set("Authorization", token)
+		p := httprouter.Params{{Key: "election_id", Value: "1020"}, {Key: "voter_id", Value: "1"}}
+		hErr := handler(httptest.NewRecorder(), r, p)
+		if (hErr == nil && code != "") || (hErr != nil && hErr.CodedMessage != code) {
+			t.Fatalf("Token %s: expected %q, got %v", token, code, hErr)
+		}
+	}
+
+	// without secrets file the shared secret is only used with
+	// legacyVoterSecret
+	s.Server.SharedSecret = SharedSecret
+	checkToken(middleware.AuthHeader("voter-1020-1", SharedSecret), "")
+	checkToken(middleware.AuthHeader("voter-1020-2", SharedSecret), "invalid-auth")
+	tb.legacyVoterSecret = false
+	checkToken(middleware.AuthHeader("voter-1020-1", SharedSecret), "invalid-auth")
+
+	tb.writeElectionFile("1020", "secrets_1020", "old\n")
+	tb.RequestJson("POST", "/api/v1/ballotbox/reload-config", http.StatusAccepted, adminHeaders(), "{}")
+	checkToken(middleware.AuthHeader("voter-1020-1", SharedSecret), "invalid-auth")
+	checkToken(middleware.AuthHeader("voter-1020-1", "old"), "")
+
+	// rotation, both secrets are accepted until the old one is removed
+	tb.writeElectionFile("1020", "secrets_1020", "new\nold\n")
+	tb.RequestJson("POST", "/api/v1/ballotbox/reload-config", http.StatusAccepted, adminHeaders(), "{}")
+	checkToken(middleware.AuthHeader("voter-1020-1", "old"), "")
+	checkToken(middleware.AuthHeader("voter-1020-1", "new"), "")
+	tb.writeElectionFile("1020", "secrets_1020", "new\n")
+	tb.RequestJson("POST", "/api/v1/ballotbox/reload-config", http.StatusAccepted, adminHeaders(), "{}")
+	checkToken(middleware.AuthHeader("voter-1020-1", "old"), "invalid-auth")
+	checkToken(middleware.AuthHeader("voter-1020-1", "new"), "")
+
+	// an empty secrets file doesn't load the election
+	tb.writeElectionFile("1020", "secrets_1020", "\n")
+	reloaded := tb.RequestJson("POST", "/api/v1/ballotbox/reload-config", http.StatusAccepted, adminHeaders(), "{}").(map[string]interface{})
+	if reloaded["errors"].(map[string]interface{})["1020"] == nil {
+		t.Fatalf("Election with empty secrets loaded %v", reloaded)
+	}
+}
+
+func TestCheckAuthHeader(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	token := func(message string, secret string) string {
+		h := hmac.New(sha256.New, []byte(secret))
+		h.Write([]byte(message))
+		return fmt.Sprintf("%s:%x", message, h.Sum(nil))
+	}
+	checks := []struct {
+		header string
+		valid  bool
+	}{
+		{token("voter-1-1:1000000", "a"), true},
+		{token("voter-1-1:999950", "b"), true},
+		{token("voter-1-1:999900", "a"), false},
+		{token("voter-1-1:1000100", "a"), false},
+		{token("voter-1-10:1000000", "a"), false},
+		{token("voter-1-1:1000000", "c"), false},
+		{"voter-1-1:1000000", false},
+		{"", false},
+	}
+	for _, check := range checks {
+		if (checkAuthHeader(check.header, "voter-1-1", []string{"a", "b"}, 60, now) != nil) != check.valid {
+			t.Fatalf("Header %s: expected %v", check.header, check.valid)
+		}
+	}
+	if checkAuthHeader(token("voter-1-1:1", "a"), "voter-1-1", []string{"a"}, 0, now) == nil {
+		t.Fatalf("Token expired without session expire")
+	}
+}
+
+// testAuthKey returns a new key and its authkeys file
+func testAuthKey(t *testing.T, rsaKey bool) (crypto.Signer, string) {
+	var (
+		key crypto.Signer
+		err error
+	)
+	if rsaKey {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatalf("Error generating key %v", err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("Error marshalling key %v", err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}))
+}
+
+func TestVoterToken(t *testing.T) {
+	now := time.Now()
+	edKey, edPem := testAuthKey(t, false)
+	rsaKey, rsaPem := testAuthKey(t, true)
+	otherKey, _ := testAuthKey(t, false)
+	keys, err := parseAuthKeys(edPem + rsaPem)
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("Error parsing keys %v", err)
+	}
+
+	for _, key := range []crypto.Signer{edKey, rsaKey} {
+		token, err := SignVoterToken(key, "voter-1-1", now.Add(time.Hour), "")
+		if err != nil {
+			t.Fatalf("Error signing token %v", err)
+		}
+		if checkVoterToken(token, "voter-1-1", keys, now) == nil {
+			t.Fatalf("Valid token refused %s", token)
+		}
+		if checkVoterToken(token, "voter-1-2", keys, now) != nil {
+			t.Fatalf("Token accepted for another voter")
+		}
+		if checkVoterToken(token, "voter-1-1", keys, now.Add(2*time.Hour)) != nil {
+			t.Fatalf("Expired token accepted")
+		}
+		parts := strings.Split(token, ".")
+		claims, _ := json.Marshal(tokenClaims{Sub: "voter-1-2", Exp: now.Add(time.Hour).Unix()})
+		forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString(claims) + "." + parts[2]
+		if checkVoterToken(forged, "voter-1-2", keys, now) != nil {
+			t.Fatalf("Token with modified claims accepted")
+		}
+	}
+
+	token, _ := SignVoterToken(otherKey, "voter-1-1", now.Add(time.Hour), "")
+	if checkVoterToken(token, "voter-1-1", keys, now) != nil {
+		t.Fatalf("Token of an unknown key accepted")
+	}
+	// an RS256 header doesn't make an ed25519 signature checked as rsa
+	token, _ = SignVoterToken(edKey, "voter-1-1", now.Add(time.Hour), "")
+	header, _ := json.Marshal(tokenHeader{Alg: "RS256", Typ: "JWT"})
+	parts := strings.Split(token, ".")
+	if checkVoterToken(base64.RawURLEncoding.EncodeToString(header)+"."+parts[1]+"."+parts[2], "voter-1-1", keys, now) != nil {
+		t.Fatalf("Token with another algorithm accepted")
+	}
+	if _, err = parseAuthKeys("bogus"); err == nil {
+		t.Fatalf("Empty auth keys parsed")
+	}
+
+	// short rsa keys are refused
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Error generating key %v", err)
+	}
+	weak, _ := x509.MarshalPKIXPublicKey(weakKey.Public())
+	if _, err = parseAuthKeys(edPem + string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: weak}))); err == nil {
+		t.Fatalf("1024 bit RSA key parsed")
+	}
+}
+
+func TestBallotBoxVoterToken(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+	tb.clock = time.Now
+	s.Server.SharedSecret = SharedSecret
+	handler := tb.voterAuth("voter-${election_id}-${voter_id}", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+		return nil
+	})
+	checkToken := func(token string, valid bool) {
+		r := httptest.NewRequest("POST", "/election/1020/vote/1", nil)
+		r.Header.Set("Authorization", token)
+		p := httprouter.Params{{Key: "election_id", Value: "1020"}, {Key: "voter_id", Value: "1"}}
+		if hErr := handler(httptest.NewRecorder(), r, p); (hErr == nil) != valid {
+			t.Fatalf("Token %s: expected valid %v, got %v", token, valid, hErr)
+		}
+	}
+
+	key, keyPem := testAuthKey(t, false)
+	tb.writeElectionFile("1020", "authkeys_1020", keyPem)
+	tb.RequestJson("POST", "/api/v1/ballotbox/reload-config", http.StatusAccepted, adminHeaders(), "{}")
+	token, _ := SignVoterToken(key, "voter-1020-1", time.Now().Add(time.Minute), "")
+	checkToken("Bearer "+token, true)
+	checkToken(token, false)
+	checkToken(middleware.AuthHeader("voter-1020-1", SharedSecret), false)
+
+	// secrets and keys can't be combined
+	tb.writeElectionFile("1020", "secrets_1020", "secret\n")
+	reloaded := tb.RequestJson("POST", "/api/v1/ballotbox/reload-config", http.StatusAccepted, adminHeaders(), "{}").(map[string]interface{})
+	if reloaded["errors"].(map[string]interface{})["1020"] == nil {
+		t.Fatalf("Election with secrets and auth keys loaded %v", reloaded)
+	}
+}
+
+func TestBallotBoxOneTimeTokens(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+	s.Server.SharedSecret = SharedSecret
+	var failure *middleware.HandledError
+	handler := tb.voterAuth("voter-${election_id}-${voter_id}", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+		return failure
+	})
+	request := func(method string, token string, code string) {
+		r := httptest.NewRequest(method, "/election/1020/vote/1", nil)
+		r.Header.Set("Authorization", token)
+		p := httprouter.Params{{Key: "election_id", Value: "1020"}, {Key: "voter_id", Value: "1"}}
+		hErr := handler(httptest.NewRecorder(), r, p)
+		if (hErr == nil && code != "") || (hErr != nil && hErr.CodedMessage != code) {
+			t.Fatalf("Token %s: expected %q, got %v", token, code, hErr)
+		}
+	}
+	checkToken := func(token string, code string) {
+		request("POST", token, code)
+	}
+
+	// tokens can be replayed unless the election enables one-time tokens
+	token := middleware.AuthHeader("voter-1020-1", SharedSecret)
+	checkToken(token, "")
+	checkToken(token, "")
+	once := OneTimeAuthHeader("voter-1020-1", SharedSecret)
+	checkToken(once, "")
+	checkToken(once, "")
+
+	var cfg map[string]interface{}
+	json.Unmarshal([]byte(tb.configs["1020"]), &cfg)
+	cfg["one_time_tokens"] = true
+	b, _ := json.Marshal(cfg)
+	tb.writeElectionFile("1020", "config.json", string(b))
+	tb.RequestJson("POST", "/api/v1/ballotbox/reload-config", http.StatusAccepted, adminHeaders(), "{}")
+
+	checkToken(token, "nonce-required")
+	once = OneTimeAuthHeader("voter-1020-1", SharedSecret)
+	checkToken(once, "")
+	checkToken(once, "token-reused")
+	checkToken(OneTimeAuthHeader("voter-1020-1", SharedSecret), "")
+	// the nonce is covered by the hmac
+	fields := strings.Split(once, ":")
+	fields[2] = NewNonce()
+	checkToken(strings.Join(fields, ":"), "invalid-auth")
+
+	// reads don't use the nonce, and a failed cast gives it back
+	once = OneTimeAuthHeader("voter-1020-1", SharedSecret)
+	request("GET", once, "")
+	request("GET", token, "")
+	failure = &middleware.HandledError{Code: 400, CodedMessage: "invalid-vote"}
+	checkToken(once, "invalid-vote")
+	checkToken(once, "invalid-vote")
+	failure = nil
+	checkToken(once, "")
+	checkToken(once, "token-reused")
+
+	// signed tokens carry the nonce as jti
+	tb.clock = time.Now
+	key, keyPem := testAuthKey(t, false)
+	tb.writeElectionFile("1020", "authkeys_1020", keyPem)
+	tb.RequestJson("POST", "/api/v1/ballotbox/reload-config", http.StatusAccepted, adminHeaders(), "{}")
+	signed, _ := SignVoterToken(key, "voter-1020-1", time.Now().Add(time.Minute), NewNonce())
+	checkToken("Bearer "+signed, "")
+	checkToken("Bearer "+signed, "token-reused")
+	signed, _ = SignVoterToken(key, "voter-1020-1", time.Now().Add(time.Minute), "")
+	checkToken("Bearer "+signed, "nonce-required")
+}
+
+func TestAdminGrants(t *testing.T) {
+	checks := []struct {
+		perm     string
+		required string
+		granted  bool
+	}{
+		{"global-admin", "global-admin", true},
+		{"global-admin", "admin-1-write", true},
+		{"admin", "admin-1-read", true},
+		{"admin-1-write", "admin-1-write", true},
+		{"admin-1-write", "admin-1-read", true},
+		{"admin-1-read", "admin-1-read", true},
+		{"admin-1-read", "admin-1-write", false},
+		{"admin-1-write", "admin-2-read", false},
+		{"admin-1-write", "global-admin", false},
+		{"voter-1-1", "admin-1-read", false},
+	}
+	for _, check := range checks {
+		if adminGrants(check.perm, check.required) != check.granted {
+			t.Fatalf("%s for %s: expected %v", check.perm, check.required, check.granted)
+		}
+	}
+}
+
+func TestBallotBoxAdminAuth(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+	var logged bytes.Buffer
+	logger, admins := s.Server.Logger, s.Server.Admins
+	s.Server.Logger = log.New(&logged, "", 0)
+	s.Server.Admins = []string{"test@example.com"}
+	s.Server.SharedSecret = SharedSecret
+	defer func() {
+		s.Server.Logger, s.Server.Admins = logger, admins
+	}()
+
+	checkToken := func(perm string, token string, code string) {
+		handler := tb.adminAuth(perm, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+			return nil
+		})
+		r := httptest.NewRequest("POST", "/election/1020/state/open", nil)
+		r.Header.Set("Authorization", token)
+		hErr := handler(httptest.NewRecorder(), r, httprouter.Params{{Key: "election_id", Value: "1020"}})
+		if (hErr == nil && code != "") || (hErr != nil && hErr.CodedMessage != code) {
+			t.Fatalf("%s with %s: expected %q, got %v", perm, token, code, hErr)
+		}
+	}
+
+	write := AdminAuthHeader("admin-1020-write", "test@example.com", SharedSecret)
+	checkToken("admin-${election_id}-write", write, "")
+	checkToken("admin-${election_id}-read", write, "")
+	checkToken("global-admin", write, "permission-denied")
+	checkToken("admin-${election_id}-write", AdminAuthHeader("admin-1020-read", "test@example.com", SharedSecret), "permission-denied")
+	checkToken("admin-${election_id}-write", AdminAuthHeader("admin-1021-write", "test@example.com", SharedSecret), "permission-denied")
+	checkToken("global-admin", AdminAuthHeader("global-admin", "test@example.com", SharedSecret), "")
+	checkToken("global-admin", AdminAuthHeader("global-admin", "other@example.com", SharedSecret), "unknown-admin")
+	checkToken("global-admin", AdminAuthHeader("global-admin", "test@example.com", "othersecret"), "invalid-auth")
+	checkToken("admin-${election_id}-write", middleware.AuthHeader("admin-1020-write", SharedSecret), "invalid-auth")
+	// the legacy admin token still works, and election secrets don't grant
+	// admin permissions
+	checkToken("global-admin", middleware.AuthHeader("admin", SharedSecret), "")
+	tb.writeElectionFile("1020", "secrets_1020", "electionsecret\n")
+	tb.RequestJson("POST", "/api/v1/ballotbox/reload-config", http.StatusAccepted, adminHeaders(), "{}")
+	checkToken("admin-${election_id}-read", AdminAuthHeader("admin-1020-read", "test@example.com", "electionsecret"), "invalid-auth")
+
+	lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+	var calls []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "Admin call ") {
+			calls = append(calls, line)
+		}
+	}
+	if len(calls) != 12 ||
+		calls[0] != "Admin call POST /election/1020/state/open by test@example.com with admin-1020-write: ok" ||
+		calls[2] != "Admin call POST /election/1020/state/open by test@example.com with global-admin: 403 permission-denied" ||
+		calls[9] != "Admin call POST /election/1020/state/open by - with global-admin: ok" {
+		t.Fatalf("Unexpected admin log %q", calls)
+	}
+}
+
+func TestBallotBoxBulletinBoard(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+	openElection(tb, "1020")
+	tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusAccepted, voterHeaders("1020", "1"), newVoteJson)
+
+	// no authentication required
+	board := tb.RequestJson("GET", "/api/v1/ballotbox/election/1020/bulletin-board", http.StatusOK, nil, "").(map[string]interface{})
+	ballots := board["ballots"].([]interface{})
+	if len(ballots) != 1 || ballots[0].(map[string]interface{})["vote_hash"] != newVoteHash {
+		t.Fatalf("Unexpected bulletin board %v", board)
+	}
+	if _, ok := ballots[0].(map[string]interface{})["vote"]; ok {
+		t.Fatalf("Ciphertexts included without being requested")
+	}
+
+	board = tb.RequestJson("GET", "/api/v1/ballotbox/election/1020/bulletin-board?ciphertexts=true&limit=1", http.StatusOK, nil, "").(map[string]interface{})
+	ballots = board["ballots"].([]interface{})
+	if len(ballots) != 1 || ballots[0].(map[string]interface{})["vote"] == nil || board["next"] == nil {
+		t.Fatalf("Unexpected bulletin board page %v", board)
+	}
+	board = tb.RequestJson("GET", fmt.Sprintf("/api/v1/ballotbox/election/1020/bulletin-board?after=%v", board["next"]), http.StatusOK, nil, "").(map[string]interface{})
+	if len(board["ballots"].([]interface{})) != 0 {
+		t.Fatalf("Unexpected bulletin board page %v", board)
+	}
+
+	tb.Request("GET", "/api/v1/ballotbox/election/1020/bulletin-board?limit=0", http.StatusBadRequest, nil, "")
+	tb.Request("GET", "/api/v1/ballotbox/election/bogus/bulletin-board", http.StatusNotFound, nil, "")
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	parse := func(text string) map[string]*json.RawMessage {
+		var cfg map[string]*json.RawMessage
+		if err := json.Unmarshal([]byte(text), &cfg); err != nil {
+			t.Fatalf("Error parsing config %v", err)
+		}
+		return cfg
+	}
+	if _, err := loadSigningKey(parse(`{}`)); err == nil {
+		t.Fatalf("A missing signingKey should be an error")
+	}
+	if key, err := loadSigningKey(parse(`{"temporarySigningKey": true}`)); err != nil || len(key) != ed25519.PrivateKeySize {
+		t.Fatalf("Expected a temporary key, got %v", err)
+	}
+	seed := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	key, err := loadSigningKey(parse(`{"signingKey": "` + seed + `", "temporarySigningKey": true}`))
+	if err != nil || !key.Equal(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))) {
+		t.Fatalf("Expected the configured key, got %v", err)
+	}
+	if _, err := loadSigningKey(parse(`{"signingKey": "c2hvcnQ="}`)); err == nil {
+		t.Fatalf("A short signingKey should be an error")
+	}
+}
+
+func TestMerkleTree(t *testing.T) {
+	for size := 1; size <= 33; size++ {
+		incremental := newMerkleTree()
+		hashes := make([]string, size)
+		for i := range hashes {
+			hashes[i] = HashSha256(strconv.Itoa(i))
+			incremental.set(int64(i+1), hashes[i])
+		}
+		root := incremental.root()
+
+		for _, hash := range hashes {
+			_, path, ok := incremental.proof(hash)
+			if !ok || !VerifyInclusionProof(hash, path, root) {
+				t.Fatalf("Inclusion proof failed for size %d", size)
+			}
+			if VerifyInclusionProof(HashSha256("bogus"), path, root) {
+				t.Fatalf("Inclusion proof verified for a bogus hash")
+			}
+		}
+
+		// re-casting replaces the leaf in place
+		recast := HashSha256("recast")
+		incremental.set(int64(size), recast)
+		if incremental.root() == root || incremental.size() != size {
+			t.Fatalf("Root not updated after re-cast for size %d", size)
+		}
+		if _, _, ok := incremental.proof(hashes[size-1]); ok {
+			t.Fatalf("Proof found for a replaced ballot")
+		}
+
+		// building from scratch gives the same root
+		rebuilt := newMerkleTree()
+		for i, hash := range append(hashes[:size-1], recast) {
+			rebuilt.set(int64(i+1), hash)
+		}
+		if rebuilt.root() != incremental.root() {
+			t.Fatalf("Rebuilt root mismatch for size %d", size)
+		}
+		_, path, _ := rebuilt.proof(recast)
+		if !VerifyInclusionProof(recast, path, incremental.root()) {
+			t.Fatalf("Inclusion proof failed after re-cast for size %d", size)
+		}
+	}
+
+	tree := newMerkleTree()
+	tree.set(2, HashSha256("a"))
+	tree.set(1, HashSha256("b"))
+	if !tree.dirty {
+		t.Fatalf("Out of order vote should mark the tree for rebuild")
+	}
+}
+
+// testVoteStore checks the VoteStore contract, as set_vote implements it
+func testVoteStore(t *testing.T, store VoteStore) {
+	castWith := func(limits CastLimits, electionId string, voterId string, vote string) (*Vote, CastResult) {
+		v := &Vote{Vote: vote, VoteHash: HashSha256(vote), ElectionId: electionId, VoterId: voterId}
+		result, err := store.CastVote(v, "127.0.0.1", limits)
+		if err != nil {
+			t.Fatalf("Error casting vote %v", err)
+		}
+		return v, result
+	}
+	cast := func(electionId string, voterId string, vote string) (*Vote, CastResult) {
+		return castWith(CastLimits{MaxWrites: 2}, electionId, voterId, vote)
+	}
+
+	first, result := cast("1", "a", "vote 1")
+	if result != CastStored || first.Id == 0 || first.WriteCount != 1 {
+		t.Fatalf("Unexpected first cast %v %v", result, first)
+	}
+	second, _ := cast("1", "b", "vote 2")
+	cast("2", "a", "vote 3")
+	// replaced votes keep their id
+	if v, result := cast("1", "a", "vote 4"); result != CastStored || v.Id != first.Id || v.WriteCount != 2 {
+		t.Fatalf("Unexpected recast %v %v", result, v)
+	}
+	if _, result := cast("1", "a", "vote 5"); result != CastMaxWrites {
+		t.Fatalf("Expected max writes, got %v", result)
+	}
+	if _, result := cast("1", "c", "vote 2"); result != CastHashTaken {
+		t.Fatalf("Expected hash taken, got %v", result)
+	}
+	// hashes are unique across elections too
+	if _, result := cast("3", "a", "vote 3"); result != CastHashTaken {
+		t.Fatalf("Expected hash taken, got %v", result)
+	}
+
+	// re-vote policies
+	if _, result := castWith(CastLimits{Cooldown: time.Hour}, "2", "a", "vote 6"); result != CastCooldown {
+		t.Fatalf("Expected cooldown, got %v", result)
+	}
+	if _, result := castWith(CastLimits{}, "2", "a", "vote 6"); result != CastStored {
+		t.Fatalf("Expected unlimited re-cast, got %v", result)
+	}
+	if _, result := castWith(CastLimits{KeepFirst: true}, "2", "a", "vote 7"); result != CastRecorded {
+		t.Fatalf("Expected recorded, got %v", result)
+	}
+	if v, _ := store.FindVote("2", "a", HashSha256("vote 6")); v == nil {
+		t.Fatalf("First vote counts re-cast replaced the counted ballot")
+	}
+	if history, _ := store.VoteHistory("2", "a"); len(history) != 3 || !history[1].Counted || history[2].Counted || history[2].WriteCount != 3 {
+		t.Fatalf("Unexpected history %v", history)
+	}
+
+	if v, err := store.FindVote("1", "a", HashSha256("vote 4")); err != nil || v == nil || v.Vote != "vote 4" {
+		t.Fatalf("Unexpected found vote %v %v", v, err)
+	}
+	if v, err := store.FindVote("1", "a", HashSha256("vote 1")); err != nil || v != nil {
+		t.Fatalf("Found a replaced vote %v %v", v, err)
+	}
+	if count, err := store.CountVotes("1"); err != nil || count != 2 {
+		t.Fatalf("Unexpected count %d %v", count, err)
+	}
+
+	// refused casts are not recorded
+	history, err := store.VoteHistory("1", "a")
+	if err != nil || len(history) != 2 {
+		t.Fatalf("Unexpected history %v %v", history, err)
+	}
+	for i, vote := range []string{"vote 1", "vote 4"} {
+		if history[i].Vote != vote || history[i].VoteHash != HashSha256(vote) || history[i].WriteCount != int64(i+1) || history[i].Ip != "127.0.0.1" {
+			t.Fatalf("Unexpected cast %v", history[i])
+		}
+	}
+	if history, err = store.VoteHistory("1", "c"); err != nil || len(history) != 0 {
+		t.Fatalf("Unexpected history %v %v", history, err)
+	}
+
+	var ids []int64
+	err = store.IterateVotes("1", 0, 0, true, func(v *Vote) error {
+		if v.Vote == "" || v.VoteHash != HashSha256(v.Vote) || v.Ip == "" || v.WriteCount == 0 || v.Created.IsZero() {
+			t.Fatalf("Unexpected iterated vote %v", v)
+		}
+		ids = append(ids, v.Id)
+		return nil
+	})
+	if err != nil || len(ids) != 2 || ids[0] != first.Id || ids[1] != second.Id {
+		t.Fatalf("Unexpected iteration %v %v", ids, err)
+	}
+	ids = nil
+	store.IterateVotes("1", first.Id, 1, false, func(v *Vote) error {
+		if v.Vote != "" {
+			t.Fatalf("Vote loaded without withVote")
+		}
+		ids = append(ids, v.Id)
+		return nil
+	})
+	if len(ids) != 1 || ids[0] != second.Id {
+		t.Fatalf("Unexpected page %v", ids)
+	}
+
+	if err = store.SetElectionState("1", StateKeysReady, StateOpen); err != nil {
+		t.Fatalf("Error setting state %v", err)
+	}
+	if err = store.SetElectionState("1", StateKeysReady, StateOpen); err != ErrStateConflict {
+		t.Fatalf("Expected a state conflict, got %v", err)
+	}
+	if err = store.SetElectionState("1", StateOpen, StateClosed); err != nil {
+		t.Fatalf("Error setting state %v", err)
+	}
+	if states, err := store.ElectionStates(); err != nil || len(states) != 1 || states["1"] != StateClosed {
+		t.Fatalf("Unexpected states %v %v", states, err)
+	}
+
+	if added, err := store.AddToCensus("1", []string{"a", "b", "a"}); err != nil || added != 2 {
+		t.Fatalf("Unexpected census insert %d %v", added, err)
+	}
+	if added, err := store.AddToCensus("1", []string{"b", "c"}); err != nil || added != 1 {
+		t.Fatalf("Unexpected census insert %d %v", added, err)
+	}
+	if ok, _ := store.InCensus("1", "c"); !ok {
+		t.Fatalf("Voter not in census")
+	}
+	if ok, _ := store.InCensus("2", "c"); ok {
+		t.Fatalf("Voter in the census of another election")
+	}
+	if removed, err := store.RemoveFromCensus("1", "c"); err != nil || !removed {
+		t.Fatalf("Voter not removed %v", err)
+	}
+	if removed, _ := store.RemoveFromCensus("1", "c"); removed {
+		t.Fatalf("Voter removed twice")
+	}
+	if size, err := store.CensusSize("1"); err != nil || size != 2 {
+		t.Fatalf("Unexpected census size %d %v", size, err)
+	}
+	store.RemoveFromCensus("1", "a")
+	store.RemoveFromCensus("1", "b")
+	if ok, err := store.HasCensus("1"); err != nil || !ok {
+		t.Fatalf("Emptied census dropped %v", err)
+	}
+	if ok, _ := store.HasCensus("2"); ok {
+		t.Fatalf("Census of an election without voters")
+	}
+	if _, err := store.AddToCensus("3", nil); err != nil {
+		t.Fatalf("Error adding an empty census %v", err)
+	}
+	if ok, _ := store.HasCensus("3"); !ok {
+		t.Fatalf("Empty census not recorded")
+	}
+
+	hour := time.Now().Add(time.Hour)
+	if fresh, err := store.UseNonce("1", "n", hour); err != nil || !fresh {
+		t.Fatalf("Nonce not recorded %v", err)
+	}
+	if fresh, _ := store.UseNonce("1", "n", hour); fresh {
+		t.Fatalf("Nonce used twice")
+	}
+	if fresh, _ := store.UseNonce("2", "n", hour); !fresh {
+		t.Fatalf("Nonce of another election refused")
+	}
+	if fresh, _ := store.UseNonce("1", "forever", time.Time{}); !fresh {
+		t.Fatalf("Nonce without expiration refused")
+	}
+	if fresh, _ := store.UseNonce("1", "forever", hour); fresh {
+		t.Fatalf("Nonce without expiration used twice")
+	}
+	store.UseNonce("1", "expired", time.Now().Add(-time.Second))
+	if fresh, _ := store.UseNonce("1", "expired", hour); !fresh {
+		t.Fatalf("Expired nonce kept")
+	}
+}
+
+func TestVoteStores(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testVoteStore(t, newMemoryStore())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		store, err := openSqliteStore(path.Join(t.TempDir(), "votes.db"))
+		if err != nil {
+			t.Fatalf("Error opening sqlite store %v", err)
+		}
+		defer store.db.Close()
+		testVoteStore(t, store)
+	})
+}
+
+func TestBallotBoxMerkleRoot(t *testing.T) {
+	tb := newTestBallotBox(t)
+	defer tb.TearDown()
+	openElection(tb, "1020")
+	tb.RequestJson("POST", "/api/v1/ballotbox/election/1020/vote/1", http.StatusAccepted, voterHeaders("1020", "1"), newVoteJson)
+
+	var root MerkleRoot
+	body := tb.Request("GET", "/api/v1/ballotbox/election/1020/merkle-root", http.StatusOK, nil, "")
+	if err := json.Unmarshal(body, &root); err != nil {
+		t.Fatalf("Error parsing merkle root %v", err)
+	}
+	if !verifySignature(tb.signingKey.Public().(ed25519.PublicKey), root.message(), root.Signature) {
+		t.Fatalf("Invalid merkle root signature")
+	}
+
+	var proof InclusionProof
+	body = tb.Request("GET", fmt.Sprintf("/api/v1/ballotbox/election/1020/inclusion-proof/%s", newVoteHash), http.StatusOK, nil, "")
+	if err := json.Unmarshal(body, &proof); err != nil {
+		t.Fatalf("Error parsing inclusion proof %v", err)
+	}
+	if !VerifyInclusionProof(newVoteHash, proof.Path, proof.Root.Root) || proof.Root.Root != root.Root {
+		t.Fatalf("Invalid inclusion proof %v", proof)
+	}
+	tb.Request("GET", "/api/v1/ballotbox/election/1020/inclusion-proof/bogus", http.StatusNotFound, nil, "")
 }
 
 // used to benchmark a remote server
+// validation throughput of the sample ballot with the 1020 election keys
+func BenchmarkValidate(b *testing.B) {
+	elections, err := loadElectionDir("../admin/elections", func(string, ...interface{}) {})
+	if err != nil {
+		b.Fatalf("Error loading elections %v", err)
+	}
+	pks := elections.pubkeyObjects["1020"]
+	eCfg := elections.electionCfgs["1020"]
+	vote := strings.Replace(voteJson, `\"`, `"`, -1)
+
+	for _, checkResidues := range []bool{true, false} {
+		b.Run(fmt.Sprintf("checkResidues=%v", checkResidues), func(b *testing.B) {
+			v := &Vote{Vote: vote, VoteHash: HashSha256(vote)}
+			for i := 0; i < b.N; i++ {
+				if err := v.validate(pks, checkResidues, eCfg, nil); err != nil {
+					b.Fatalf("Error validating vote %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkQuadraticResidue(b *testing.B) {
+	elections, err := loadElectionDir("../admin/elections", func(string, ...interface{}) {})
+	if err != nil {
+		b.Fatalf("Error loading elections %v", err)
+	}
+	p, q := elections.pubkeyObjects["1020"][0]["p"], elections.pubkeyObjects["1020"][0]["q"]
+	value, _ := new(big.Int).SetString("14268858776014931861458608313517070856036869918360554840257322856847542098845060563400252725408151504443689640611782069657557366076314034005926105640102753331283323683927731162586702452504414900483664232251706611593914945053069881853527205681629143320755824446175436453353447242777732548179187099820852306835018099740959374580596232340402230321382898301680181371244175479546234410117758889420419144117988991505324396563056696740570337369435889659133616195621252044920649614410101433256045437156662503299740904855635301136565548458580080122151343981193276667226335535758222123736164713319848692497837135317887590138216", 10)
+
+	b.Run("jacobi", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			quadraticResidue(value, p)
+		}
+	})
+	b.Run("euler", func(b *testing.B) {
+		result := new(big.Int)
+		for i := 0; i < b.N; i++ {
+			result.Exp(value, q, p)
+		}
+	})
+}
+
+// proof verification throughput for ballots of three choices, each
+// verifier is fed from 16 * GOMAXPROCS goroutines as concurrent requests would
+func BenchmarkPopkVerifier(b *testing.B) {
+	elections, err := loadElectionDir("../admin/elections", func(string, ...interface{}) {})
+	if err != nil {
+		b.Fatalf("Error loading elections %v", err)
+	}
+	p4096, _ := new(big.Int).SetString(rfc3526Prime4096, 16)
+	q4096 := new(big.Int).Rsh(p4096, 1)
+	pks := map[int]map[string]*big.Int{
+		2048: elections.pubkeyObjects["1020"][0],
+		4096: {"p": p4096, "q": q4096, "g": big.NewInt(2)},
+	}
+
+	for _, bits := range []int{2048, 4096} {
+		ballots := make([][]proofCheck, 16)
+		for i := range ballots {
+			ballots[i] = testPopkChecks(pks[bits], 3, false)
+		}
+		for _, name := range []string{"sequential", "parallel", "batch"} {
+			b.Run(fmt.Sprintf("%d/%s", bits, name), func(b *testing.B) {
+				verifier, _ := newPopkVerifier(name, 0, 0)
+				if batch, ok := verifier.(*batchVerifier); ok {
+					defer batch.stop()
+				}
+				var next int64
+				b.SetParallelism(16)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						i := atomic.AddInt64(&next, 1)
+						if err := verifier.verify(ballots[i%int64(len(ballots))]); err != nil {
+							b.Errorf("Error verifying proofs %v", err)
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
 func BenchmarkApi(b *testing.B) {
     secret := SharedSecret
 
@@ -153,7 +2168,7 @@ func request(method string, path string, headers map[string]string, requesTBody
 
 // used to parse command line arguments when running benchmark against remote server
 // (see http://golang.org/pkg/flag/ example)
-func init() {
+func TestMain(m *testing.M) {
 	var err error
 
 	addr := flag.String("port", "3000", "http port")
@@ -168,4 +2183,5 @@ func init() {
     str := strings.Replace(voteJson, `\"`, `"`, -1)
     newVoteHash = HashSha256(str)
     newVoteJson = fmt.Sprintf(_newVoteJson, voteJson, newVoteHash)
-}
+    os.Exit(m.Run())
+}
\ No newline at end of file
@@ -0,0 +1,106 @@
+package ballotbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/agoravoting/agora-http-go/middleware"
+	s "github.com/agoravoting/agora-http-go/server"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	bulletinBoardDefaultLimit = 1000
+	bulletinBoardMaxLimit     = 10000
+)
+
+// BulletinBoardEntry is a counted ballot as published in the bulletin board,
+// without any voter data
+type BulletinBoardEntry struct {
+	Id       int64  `json:"id" db:"id"`
+	VoteHash string `json:"vote_hash" db:"vote_hash"`
+	Vote     string `json:"vote,omitempty" db:"vote"`
+}
+
+// parses an optional non negative integer query parameter
+func queryInt(r *http.Request, key string, def int64) (int64, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return def, nil
+	}
+	ret, err := strconv.ParseInt(value, 10, 64)
+	if err == nil && ret < 0 {
+		err = fmt.Errorf("Negative value for %s", key)
+	}
+	return ret, err
+}
+
+// getBulletinBoard publishes the currently counted ballots of an election,
+// ordered by id. Pages are requested with ?after=<last id>&limit=<n>, and
+// ?ciphertexts=true includes the encrypted votes along with their hashes.
+// The response is streamed from the vote store as it is read
+func (bb *BallotBox) getBulletinBoard(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+	var err error
+
+	electionId := p.ByName("election_id")
+	if electionId == "" {
+		return &middleware.HandledError{Err: err, Code: 400, Message: "No election_id", CodedMessage: "empty-election-id"}
+	}
+	if hErr := bb.checkElectionStarted(electionId); hErr != nil {
+		return hErr
+	}
+
+	after, err := queryInt(r, "after", 0)
+	if err != nil {
+		return &middleware.HandledError{Err: err, Code: 400, Message: "Invalid after parameter", CodedMessage: "invalid-format"}
+	}
+	limit, err := queryInt(r, "limit", bulletinBoardDefaultLimit)
+	if err != nil || limit == 0 || limit > bulletinBoardMaxLimit {
+		return &middleware.HandledError{Err: err, Code: 400, Message: "Invalid limit parameter", CodedMessage: "invalid-format"}
+	}
+	ciphertexts := r.URL.Query().Get("ciphertexts") == "true"
+
+	var (
+		last  int64
+		count int64
+		b     []byte
+	)
+	if b, err = json.Marshal(electionId); err != nil {
+		return &middleware.HandledError{Err: err, Code: 500, Message: "Error marshalling the data", CodedMessage: "marshall-error"}
+	}
+
+	// from here on the status is sent, errors can only be logged
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "{\"election_id\": %s, \"ballots\": [", b)
+
+	err = bb.store.IterateVotes(electionId, after, int(limit), ciphertexts, func(v *Vote) error {
+		b, err := json.Marshal(BulletinBoardEntry{Id: v.Id, VoteHash: v.VoteHash, Vote: v.Vote})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			w.Write([]byte(","))
+		}
+		w.Write(b)
+		last = v.Id
+		count++
+		return nil
+	})
+	if err != nil {
+		// leave the document unterminated so that clients notice
+		s.Server.Logger.Printf("Error reading bulletin board for election %s %v", electionId, err)
+		return nil
+	}
+
+	// next is only present when there may be more ballots
+	if count == limit {
+		fmt.Fprintf(w, "], \"next\": %d}", last)
+	} else {
+		w.Write([]byte("]}"))
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package ballotbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/agoravoting/agora-http-go/middleware"
+	s "github.com/agoravoting/agora-http-go/server"
+	"github.com/julienschmidt/httprouter"
+)
+
+// An election has a census, the voter ids allowed to vote in it, if its
+// directory holds a census_<election-id> file, with one voter id per line, or
+// if voters were uploaded with the census routes. The census is kept in the
+// vote store, files are added to it on every load, so removing a line from
+// the file doesn't remove the voter. Elections without a census accept any
+// voter with a valid voter-<election-id>-<voter-id> permission
+
+// limit of voter ids uploaded in one request
+const censusUploadMaxSize = 100000
+
+// parseCensus returns the voter ids of a census file
+func parseCensus(text string) (voterIds []string) {
+	for _, line := range strings.Split(text, "\n") {
+		if voterId := strings.TrimSpace(line); voterId != "" {
+			voterIds = append(voterIds, voterId)
+		}
+	}
+	return
+}
+
+// loadCensus adds the census files to the store and finds which elections
+// have a census. An election with a census file has one even if it is empty,
+// and so does one whose uploaded census was emptied with the DELETE route
+func (bb *BallotBox) loadCensus(elections *electionSet) (census map[string]bool, err error) {
+	census = make(map[string]bool)
+	for electionId := range elections.configs {
+		if voterIds, ok := elections.census[electionId]; ok {
+			var added int64
+			if added, err = bb.store.AddToCensus(electionId, voterIds); err != nil {
+				return
+			}
+			s.Server.Logger.Printf("Census of election %s: %d voters added", electionId, added)
+			census[electionId] = true
+			continue
+		}
+		if census[electionId], err = bb.store.HasCensus(electionId); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (bb *BallotBox) hasCensus(electionId string) bool {
+	bb.censusMutex.RLock()
+	defer bb.censusMutex.RUnlock()
+	return bb.census[electionId]
+}
+
+// checkCensus fails unless the voter may vote in the election
+func (bb *BallotBox) checkCensus(electionId string, voterId string) *middleware.HandledError {
+	if !bb.hasCensus(electionId) {
+		return nil
+	}
+	ok, err := bb.store.InCensus(electionId, voterId)
+	if err != nil {
+		return &middleware.HandledError{Err: err, Code: 500, Message: "Database error", CodedMessage: "error-select"}
+	}
+	if !ok {
+		return &middleware.HandledError{Err: err, Code: 403, Message: "Voter not in the election census", CodedMessage: "voter-not-in-census"}
+	}
+	return nil
+}
+
+// CensusReport is the turnout of an election, Turnout is the fraction of the
+// census that has voted, 0 if there is no census
+type CensusReport struct {
+	ElectionId string  `json:"election_id"`
+	CensusSize int64   `json:"census_size"`
+	Votes      int64   `json:"votes"`
+	Turnout    float64 `json:"turnout"`
+}
+
+func (bb *BallotBox) censusReport(electionId string) (report *CensusReport, err error) {
+	report = &CensusReport{ElectionId: electionId}
+	if report.CensusSize, err = bb.store.CensusSize(electionId); err != nil {
+		return
+	}
+	if report.Votes, err = bb.store.CountVotes(electionId); err != nil {
+		return
+	}
+	if report.CensusSize > 0 {
+		report.Turnout = float64(report.Votes) / float64(report.CensusSize)
+	}
+	return
+}
+
+// censusElection returns the election id parameter, which must be a loaded
+// election
+func (bb *BallotBox) censusElection(p httprouter.Params) (string, *middleware.HandledError) {
+	electionId := p.ByName("election_id")
+	if electionId == "" {
+		return "", &middleware.HandledError{Code: 400, Message: "No election_id", CodedMessage: "empty-election-id"}
+	}
+	if _, ok := bb.configs[electionId]; !ok {
+		return "", &middleware.HandledError{Code: 404, Message: "Election not found", CodedMessage: "election-not-found"}
+	}
+	return electionId, nil
+}
+
+func (bb *BallotBox) getCensus(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+	electionId, hErr := bb.censusElection(p)
+	if hErr != nil {
+		return hErr
+	}
+	report, err := bb.censusReport(electionId)
+	if err != nil {
+		return &middleware.HandledError{Err: err, Code: 500, Message: "Database error", CodedMessage: "error-select"}
+	}
+	return writeJson(w, http.StatusOK, report)
+}
+
+// postCensus adds the json list of voter ids in the body to the census
+func (bb *BallotBox) postCensus(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+	electionId, hErr := bb.censusElection(p)
+	if hErr != nil {
+		return hErr
+	}
+
+	var voterIds []string
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &voterIds)
+	}
+	if err != nil {
+		return &middleware.HandledError{Err: err, Code: 400, Message: "Invalid json-encoded voter ids", CodedMessage: "invalid-json"}
+	}
+	if len(voterIds) == 0 || len(voterIds) > censusUploadMaxSize {
+		return &middleware.HandledError{Err: err, Code: 400, Message: "Invalid number of voter ids", CodedMessage: "invalid-format"}
+	}
+	for _, voterId := range voterIds {
+		if strings.TrimSpace(voterId) == "" {
+			return &middleware.HandledError{Err: err, Code: 400, Message: "Empty voter id", CodedMessage: "empty-voter-id"}
+		}
+	}
+
+	added, err := bb.store.AddToCensus(electionId, voterIds)
+	if err != nil {
+		return &middleware.HandledError{Err: err, Code: 500, Message: "Error adding to the census", CodedMessage: "error-insert"}
+	}
+	bb.censusMutex.Lock()
+	bb.census[electionId] = true
+	bb.censusMutex.Unlock()
+	s.Server.Logger.Printf("Census of election %s: %d voters added", electionId, added)
+
+	report, err := bb.censusReport(electionId)
+	if err != nil {
+		return &middleware.HandledError{Err: err, Code: 500, Message: "Database error", CodedMessage: "error-select"}
+	}
+	return writeJson(w, http.StatusOK, map[string]interface{}{"added": added, "census": report})
+}
+
+// deleteCensusVoter removes a voter from the census. The census stays in
+// place even if it becomes empty
+func (bb *BallotBox) deleteCensusVoter(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+	electionId, hErr := bb.censusElection(p)
+	if hErr != nil {
+		return hErr
+	}
+	voterId := p.ByName("voter_id")
+	if voterId == "" {
+		return &middleware.HandledError{Code: 400, Message: "No voter_id", CodedMessage: "empty-voter-id"}
+	}
+
+	removed, err := bb.store.RemoveFromCensus(electionId, voterId)
+	if err != nil {
+		return &middleware.HandledError{Err: err, Code: 500, Message: "Error removing from the census", CodedMessage: "error-delete"}
+	}
+	if !removed {
+		return &middleware.HandledError{Err: err, Code: 404, Message: "Not found", CodedMessage: "not-found"}
+	}
+	s.Server.Logger.Printf("Census of election %s: voter %s removed", electionId, voterId)
+	return writeJson(w, http.StatusOK, map[string]string{"election_id": electionId, "voter_id": voterId})
+}
@@ -12,6 +12,26 @@ import (
 	"fmt"
 )
 
+// BallotError is a ballot validation error, Code is the coded message
+// returned to the client
+type BallotError struct {
+	Code    string
+	Message string
+}
+
+func (e *BallotError) Error() string {
+	return e.Message
+}
+
+var (
+	ErrElectionHashMismatch = &BallotError{"election-hash-mismatch", "Election hash mismatch"}
+	ErrInvalidChoicesCount  = &BallotError{"invalid-choices-count", "Number of choices doesn't match the election questions"}
+	ErrInvalidProofsCount   = &BallotError{"invalid-proofs-count", "Number of proofs doesn't match the number of choices"}
+	ErrMissingChoice        = &BallotError{"missing-choice", "Empty choice"}
+	ErrMissingProof         = &BallotError{"missing-proof", "Empty proof"}
+	ErrInvalidPubkey        = &BallotError{"vote-pks-invalid", "Invalid election pubkey"}
+)
+
 type Vote struct {
 	Id   			int64		`json:"-"`
 	Vote            string		`json:"vote" db:"vote"`
@@ -53,12 +73,15 @@ type ElectionHash struct {
 	Value string `json:"value"`
 }
 
-func (v *Vote) validate(electionPks []map[string]*big.Int, checkResidues bool) error {
-	encryptedVote, err := ParseEncryptedVote([]byte(v.Vote))
+// validate checks the vote against the election pubkeys and config, eCfg may
+// be nil to only check the pubkeys and verifier nil to check the proofs
+// sequentially
+func (v *Vote) validate(electionPks []map[string]*big.Int, checkResidues bool, eCfg *electionCfg, verifier popkVerifier) error {
+	encryptedVote, err := parseBallot([]byte(v.Vote), eCfg)
     if err != nil {
 		return err
     }
-    if err := encryptedVote.validate(electionPks, checkResidues); err != nil {
+    if err := encryptedVote.validate(electionPks, checkResidues, eCfg, verifier); err != nil {
     	return err
     }
 
@@ -112,30 +135,33 @@ func ParseVote(r *http.Request) (v Vote, err error) {
 }
 
 
-func (e *EncryptedVote) validate(electionPks []map[string]*big.Int, checkResidues bool) (err error) {
+func (e *EncryptedVote) validate(electionPks []map[string]*big.Int, checkResidues bool, eCfg *electionCfg, verifier popkVerifier) (err error) {
 	if e.A != "encrypted-vote-v1" {
 		return errors.New("Unexpected a value")
 	}
 
-	if e.ElectionHash == nil {
-		return errors.New("Missing election hash")
-	}
-
-	if e.ElectionHash.A != "hash/sha256/value" {
-		return errors.New("Unexpected a value on election hash")
+	if err = checkBallotShape(e.ElectionHash, e.IssueDate, len(e.Choices), len(e.Proofs), len(electionPks), eCfg); err != nil {
+		return err
 	}
-
-	if e.IssueDate == "" {
-		return errors.New("Missing issue date")
+	for _, pk := range electionPks {
+		if pk == nil || pk["p"] == nil || pk["g"] == nil {
+			return ErrInvalidPubkey
+		}
 	}
 
 	for _, proof := range e.Proofs {
+		if proof == nil {
+			return ErrMissingProof
+		}
 		if err = proof.validate(); err != nil {
 			return err
 		}
 	}
 
 	for index, choice := range e.Choices {
+		if choice == nil {
+			return ErrMissingChoice
+		}
 		if checkResidues {
 			if err = choice.validate(electionPks[index]); err != nil {
 				return err
@@ -147,14 +173,17 @@ func (e *EncryptedVote) validate(electionPks []map[string]*big.Int, checkResidue
 		}
 
 	}
-	if err = e.checkPopk(electionPks); err != nil {
+	if err = e.checkPopk(electionPks, verifier); err != nil {
 		return err
 	}
 
     return nil
 }
 
-func (e *EncryptedVote) checkPopk(electionPks []map[string]*big.Int) error {
+// checkPopk checks the proof challenges and has the verifier check the proof
+// equations, nil is the sequential verifier
+func (e *EncryptedVote) checkPopk(electionPks []map[string]*big.Int, verifier popkVerifier) error {
+	checks := make([]proofCheck, len(e.Proofs))
 
 	for index, proof := range e.Proofs {
     	choice := e.Choices[index]
@@ -175,22 +204,19 @@ func (e *EncryptedVote) checkPopk(electionPks []map[string]*big.Int) error {
 			return errors.New("Popk hash mismatch")
         }
 
-        pk := electionPks[index]
-
-        first := big.NewInt(0)
-        first.Exp(pk["g"], proof.Response, pk["p"])
-
-        second := big.NewInt(0)
-        second.Exp(choice.Alpha, proof.Challenge, pk["p"])
-        second.Mul(second, proof.Commitment)
-        second.Mod(second, pk["p"])
-
-        if first.Cmp(second) != 0 {
-			return errors.New("Failed verifying popk")
-        }
+		checks[index] = &popkCheck{
+			pk:         electionPks[index],
+			alpha:      choice.Alpha,
+			commitment: proof.Commitment,
+			challenge:  proof.Challenge,
+			response:   proof.Response,
+		}
     }
 
-	return nil
+	if verifier == nil {
+		verifier = sequentialVerifier{}
+	}
+	return verifier.verify(checks)
 }
 
 func (e *EncryptedVote) Marshal() ([]byte, error) {
@@ -255,55 +281,16 @@ func (c *Choice) validate(pk map[string]*big.Int) error {
 	return nil
 }
 
+// quadraticResidue returns whether value is a quadratic residue modulo the
+// odd prime modulus, that is, for a safe prime p = 2q + 1, whether it belongs
+// to the order q subgroup. Values out of the [1, p - 1] range are rejected.
+// The ciphertexts checked are public, so the jacobi symbol is used rather
+// than the much slower Euler's criterion value^q = 1 mod p
 func quadraticResidue(value *big.Int, modulus *big.Int) bool {
-	// clone values
-	val := big.NewInt(0)
-	val.SetBytes(value.Bytes())
-	mod := big.NewInt(0)
-	mod.SetBytes(modulus.Bytes())
-
-	return legendre(val, mod) == 1
-}
-
-// http://programmingpraxis.com/2012/05/01/legendres-symbol/
-func legendre(value *big.Int, modulus *big.Int) int64 {
-	zero := big.NewInt(0)
-	two := big.NewInt(2)
-	three := big.NewInt(3)
-	four := big.NewInt(4)
-	five := big.NewInt(5)
-	eight := big.NewInt(8)
-	c1 := big.NewInt(0)
-
-	a := big.NewInt(0)
-	a.Mod(value, modulus)
-	t := big.NewInt(1)
-
-	for a.Cmp(zero) != 0 {
-		for c1.Mod(a, two).Cmp(zero) == 0 {
-			a.Div(a, two)
-
-			if c1.Mod(modulus, eight).Cmp(three) == 0 || c1.Mod(modulus, eight).Cmp(five) == 0 {
-				t.Neg(t)
-			}
-		}
-
-		// swap
-		tmp := big.NewInt(0)
-		tmp.SetBytes(a.Bytes())
-		a.SetBytes(modulus.Bytes())
-		modulus.SetBytes(tmp.Bytes())
-
-		if c1.Mod(a, four).Cmp(three) == 0 && c1.Mod(modulus, four).Cmp(three) == 0 {
-			t.Neg(t)
-		}
-		a.Mod(a, modulus)
-	}
-
-	if modulus.Cmp(big.NewInt(1)) == 0 {
-		return t.Int64()
+	if value.Sign() <= 0 || value.Cmp(modulus) >= 0 || modulus.Bit(0) == 0 {
+		return false
 	}
-	return 0
+	return big.Jacobi(value, modulus) == 1
 }
 
 func HashSha256(str string) string {
@@ -0,0 +1,242 @@
+package ballotbox
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"filippo.io/nistec"
+)
+
+// The encrypted-vote-p256-v1 format is ElGamal over the NIST P-256 curve,
+// with the same structure and proofs as encrypted-vote-v1:
+//
+//	{"a": "encrypted-vote-p256-v1",
+//	 "choices": [{"alpha": <point>, "beta": <point>}, ...],
+//	 "proofs": [{"challenge": <scalar>, "commitment": <point>, "response": <scalar>}, ...],
+//	 "election_hash": ..., "issue_date": ...}
+//
+// Points are hex encoded SEC 1 compressed points and scalars hex encoded
+// integers modulo the curve order n. Proofs are checked with
+//
+//	challenge = sha256(alpha + "/" + commitment) mod n
+//	response * G = commitment + challenge * alpha
+//
+// where the hashed alpha and commitment are the lowercase compressed points.
+// The curve has cofactor 1, so every point on it but the point at infinity is
+// in the group, decoding a point replaces the quadratic residue checks.
+//
+// The election pubkeys of this format are written in the pk file as
+//
+//	[{"curve": "P-256", "x": <decimal>, "y": <decimal>}, ...]
+//
+// the affine coordinates of the public point, and loaded as {"x", "y"} maps.
+//
+// The group operations are those of filippo.io/nistec, the constant time
+// P-256 implementation of the standard library.
+
+const ecBallotFormat = "encrypted-vote-p256-v1"
+
+const ecCurveName = "P-256"
+
+// the order n of the P-256 group
+var ecOrder, _ = new(big.Int).SetString("ffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632551", 16)
+
+var ErrInvalidPoint = &BallotError{"invalid-point", "Invalid curve point"}
+
+type ECEncryptedVote struct {
+	A            string        `json:"a"`
+	Choices      []*ECChoice   `json:"choices"`
+	ElectionHash *ElectionHash `json:"election_hash"`
+	IssueDate    string        `json:"issue_date"`
+	Proofs       []*ECPopk     `json:"proofs"`
+}
+
+type ECChoice struct {
+	Alpha string `json:"alpha"`
+	Beta  string `json:"beta"`
+}
+
+type ECPopk struct {
+	Challenge  string `json:"challenge"`
+	Commitment string `json:"commitment"`
+	Response   string `json:"response"`
+}
+
+// ecPopkCheck is the verification equation of one choice proof
+type ecPopkCheck struct {
+	alpha      *nistec.P256Point
+	commitment *nistec.P256Point
+	challenge  *big.Int
+	response   *big.Int
+}
+
+func init() {
+	registerBallotFormat(ecBallotFormat, func(data []byte) (ballot, error) {
+		v := &ECEncryptedVote{}
+		if err := json.Unmarshal(data, v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	})
+}
+
+// decodePoint parses a hex compressed point, which must be on the curve. The
+// point at infinity has no compressed encoding and is refused
+func decodePoint(str string) (*nistec.P256Point, error) {
+	data, err := hex.DecodeString(str)
+	if err != nil || len(data) != 33 {
+		return nil, ErrInvalidPoint
+	}
+	point, err := nistec.NewP256Point().SetBytes(data)
+	if err != nil {
+		return nil, ErrInvalidPoint
+	}
+	return point, nil
+}
+
+// encodePoint returns the lowercase hex compressed point
+func encodePoint(point *nistec.P256Point) string {
+	return hex.EncodeToString(point.BytesCompressed())
+}
+
+// affinePoint returns the point of the given affine coordinates, nil if it is
+// not on the curve
+func affinePoint(x *big.Int, y *big.Int) *nistec.P256Point {
+	if x.Sign() < 0 || y.Sign() < 0 || x.BitLen() > 256 || y.BitLen() > 256 {
+		return nil
+	}
+	data := make([]byte, 65)
+	data[0] = 4
+	x.FillBytes(data[1:33])
+	y.FillBytes(data[33:])
+	point, err := nistec.NewP256Point().SetBytes(data)
+	if err != nil {
+		return nil
+	}
+	return point
+}
+
+// decodeScalar parses a hex integer in [0, n)
+func decodeScalar(str string) (*big.Int, error) {
+	value, ok := new(big.Int).SetString(str, 16)
+	if !ok || value.Sign() < 0 || value.Cmp(ecOrder) >= 0 {
+		return nil, errors.New("Invalid scalar")
+	}
+	return value, nil
+}
+
+// scalarBytes returns the 32 byte big endian encoding of a scalar in [0, n)
+func scalarBytes(value *big.Int) []byte {
+	return value.FillBytes(make([]byte, 32))
+}
+
+// ecChallenge returns the expected proof challenge
+func ecChallenge(alpha *nistec.P256Point, commitment *nistec.P256Point) *big.Int {
+	hashed := sha256.Sum256([]byte(encodePoint(alpha) + "/" + encodePoint(commitment)))
+	challenge := new(big.Int).SetBytes(hashed[:])
+	return challenge.Mod(challenge, ecOrder)
+}
+
+func (c *ecPopkCheck) verify() bool {
+	left, err := nistec.NewP256Point().ScalarBaseMult(scalarBytes(c.response))
+	if err != nil {
+		return false
+	}
+	right, err := nistec.NewP256Point().ScalarMult(c.alpha, scalarBytes(c.challenge))
+	if err != nil {
+		return false
+	}
+	right.Add(right, c.commitment)
+	return bytes.Equal(left.Bytes(), right.Bytes())
+}
+
+// ecPubkey returns the public point of a P-256 election pubkey
+func ecPubkey(pk map[string]*big.Int) *nistec.P256Point {
+	if pk == nil || pk["p"] != nil || pk["x"] == nil || pk["y"] == nil {
+		return nil
+	}
+	return affinePoint(pk["x"], pk["y"])
+}
+
+// validate checks the ballot as EncryptedVote.validate does. Points are always
+// checked to be in the group, checkResidues doesn't apply
+func (e *ECEncryptedVote) validate(electionPks []map[string]*big.Int, checkResidues bool, eCfg *electionCfg, verifier popkVerifier) (err error) {
+	if e.A != ecBallotFormat {
+		return errors.New("Unexpected a value")
+	}
+	if err = checkBallotShape(e.ElectionHash, e.IssueDate, len(e.Choices), len(e.Proofs), len(electionPks), eCfg); err != nil {
+		return err
+	}
+
+	checks := make([]proofCheck, len(e.Choices))
+	for index, choice := range e.Choices {
+		if ecPubkey(electionPks[index]) == nil {
+			return ErrInvalidPubkey
+		}
+		if choice == nil {
+			return ErrMissingChoice
+		}
+		proof := e.Proofs[index]
+		if proof == nil {
+			return ErrMissingProof
+		}
+
+		check := &ecPopkCheck{}
+		if check.alpha, err = decodePoint(choice.Alpha); err != nil {
+			return err
+		}
+		if _, err = decodePoint(choice.Beta); err != nil {
+			return err
+		}
+		if check.commitment, err = decodePoint(proof.Commitment); err != nil {
+			return err
+		}
+		if check.challenge, err = decodeScalar(proof.Challenge); err != nil {
+			return errors.New("Error parsing challenge")
+		}
+		if check.response, err = decodeScalar(proof.Response); err != nil {
+			return errors.New("Error parsing response")
+		}
+		if check.challenge.Cmp(ecChallenge(check.alpha, check.commitment)) != 0 {
+			return errors.New("Popk hash mismatch")
+		}
+		checks[index] = check
+	}
+
+	if verifier == nil {
+		verifier = sequentialVerifier{}
+	}
+	return verifier.verify(checks)
+}
+
+func (e *ECEncryptedVote) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// decodeCurvePubkey reads a P-256 election pubkey, whose point must be on
+// the curve
+func decodeCurvePubkey(element map[string]interface{}) (key map[string]*big.Int, err error) {
+	if element["curve"] != ecCurveName {
+		return nil, errors.New("unsupported curve")
+	}
+	key = make(map[string]*big.Int)
+	for _, name := range []string{"x", "y"} {
+		str, ok := element[name].(string)
+		if !ok {
+			return nil, errors.New("missing " + name)
+		}
+		value, ok := new(big.Int).SetString(str, 10)
+		if !ok {
+			return nil, errors.New("invalid " + name)
+		}
+		key[name] = value
+	}
+	if affinePoint(key["x"], key["y"]) == nil {
+		return nil, errors.New("y is not on the curve")
+	}
+	return
+}
@@ -0,0 +1,474 @@
+package ballotbox
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/agoravoting/agora-http-go/util"
+)
+
+// layouts accepted for voting_start_date / voting_end_date, the first one is
+// the python isoformat() used by the admin script. Dates without a time zone
+// are considered UTC
+var electionDateLayouts = []string{
+	"2006-01-02T15:04:05.999999",
+	"2006-01-02T15:04:05",
+	time.RFC3339Nano,
+}
+
+var (
+	ErrElectionNotOpen = errors.New("Election not open yet")
+	ErrElectionClosed  = errors.New("Election closed")
+)
+
+// electionCfg holds the parsed election settings the ballotbox needs to
+// enforce, the raw config.json is kept in BallotBox.configs
+type electionCfg struct {
+	// zero values mean no limit
+	VotingStartDate time.Time
+	VotingEndDate   time.Time
+
+	// canonical hash of the config, see electionConfigHash
+	Hash string
+	// whether ballots must carry Hash as their election_hash value
+	CheckElectionHash bool
+
+	// number of entries in questions_data
+	NumQuestions int
+	Questions    []*questionCfg
+
+	// accepted ballot "a" values, see format.go
+	BallotFormats []string
+
+	// nil uses the server maxWrites, see revote.go
+	RevotePolicy *revotePolicy
+
+	// whether voter tokens can only be used once, see nonce.go
+	OneTimeTokens bool
+}
+
+// questionCfg is an entry of questions_data, as far as ballot validation is
+// concerned
+type questionCfg struct {
+	// number of answers that can be selected
+	Min int
+	Max int
+
+	NumAnswers int
+}
+
+func parseElectionCfg(cfg map[string]*json.RawMessage) (ret *electionCfg, err error) {
+	ret = &electionCfg{}
+	if ret.VotingStartDate, err = parseElectionDate(cfg, "voting_start_date"); err != nil {
+		return
+	}
+	if ret.VotingEndDate, err = parseElectionDate(cfg, "voting_end_date"); err != nil {
+		return
+	}
+	if value, ok := cfg["questions_data"]; ok && value != nil {
+		var questions []*struct {
+			Min     int                `json:"min"`
+			Max     int                `json:"max"`
+			Answers []*json.RawMessage `json:"answers"`
+		}
+		if err = json.Unmarshal(*value, &questions); err != nil {
+			return
+		}
+		ret.NumQuestions = len(questions)
+		for index, question := range questions {
+			if question == nil {
+				err = fmt.Errorf("Empty question %d", index)
+				return
+			}
+			ret.Questions = append(ret.Questions, &questionCfg{Min: question.Min, Max: question.Max, NumAnswers: len(question.Answers)})
+		}
+	}
+	if value, ok := cfg["ballot_formats"]; ok && value != nil {
+		if err = json.Unmarshal(*value, &ret.BallotFormats); err != nil {
+			return
+		}
+		for _, format := range ret.BallotFormats {
+			if _, ok := ballotFormats[format]; !ok {
+				err = errors.New("Unknown ballot format " + format)
+				return
+			}
+		}
+	}
+	if value, ok := cfg["check_election_hash"]; ok && value != nil {
+		if err = json.Unmarshal(*value, &ret.CheckElectionHash); err != nil {
+			return
+		}
+	}
+	if ret.RevotePolicy, err = parseRevotePolicy(cfg); err != nil {
+		return
+	}
+	if value, ok := cfg["one_time_tokens"]; ok && value != nil {
+		if err = json.Unmarshal(*value, &ret.OneTimeTokens); err != nil {
+			return
+		}
+	}
+	if !ret.VotingStartDate.IsZero() && !ret.VotingEndDate.IsZero() && ret.VotingEndDate.Before(ret.VotingStartDate) {
+		err = errors.New("voting_end_date is before voting_start_date")
+	}
+	return
+}
+
+// electionConfigHash returns the hex encoded sha256 of the config json
+// serialized with sorted keys, no whitespace and no html escaping, the same
+// as JSON.stringify with sorted keys in the voting booth. Numbers are kept
+// as written
+func electionConfigHash(cfgText string) (hash string, err error) {
+	var cfg interface{}
+	decoder := json.NewDecoder(strings.NewReader(cfgText))
+	decoder.UseNumber()
+	if err = decoder.Decode(&cfg); err != nil {
+		return
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err = encoder.Encode(cfg); err != nil {
+		return
+	}
+	return HashSha256(strings.TrimSuffix(buffer.String(), "\n")), nil
+}
+
+// expectedHash returns the election_hash value ballots must have, empty if
+// it is not checked
+func (e *electionCfg) expectedHash() string {
+	if e == nil || !e.CheckElectionHash {
+		return ""
+	}
+	return e.Hash
+}
+
+// numQuestions returns the number of questions of the election, 0 if unknown
+func (e *electionCfg) numQuestions() int {
+	if e == nil {
+		return 0
+	}
+	return e.NumQuestions
+}
+
+// acceptsFormat returns whether ballots with the given "a" value can be cast,
+// only the default format if the election doesn't list any
+func (e *electionCfg) acceptsFormat(a string) bool {
+	if e == nil || len(e.BallotFormats) == 0 {
+		return a == defaultBallotFormat
+	}
+	for _, format := range e.BallotFormats {
+		if format == a {
+			return true
+		}
+	}
+	return false
+}
+
+func parseElectionDate(cfg map[string]*json.RawMessage, key string) (date time.Time, err error) {
+	value, ok := cfg[key]
+	if !ok || value == nil {
+		return
+	}
+	var str string
+	if err = json.Unmarshal(*value, &str); err != nil || str == "" {
+		return
+	}
+	for _, layout := range electionDateLayouts {
+		if date, err = time.Parse(layout, str); err == nil {
+			return
+		}
+	}
+	err = errors.New("Invalid date format for " + key + ": " + str)
+	return
+}
+
+// checkVotingWindow returns an error if now is outside the voting window of
+// the election, widened on both ends by the allowed clock skew
+func (e *electionCfg) checkVotingWindow(now time.Time, skew time.Duration) error {
+	if !e.VotingStartDate.IsZero() && now.Before(e.VotingStartDate.Add(-skew)) {
+		return ErrElectionNotOpen
+	}
+	if !e.VotingEndDate.IsZero() && now.After(e.VotingEndDate.Add(skew)) {
+		return ErrElectionClosed
+	}
+	return nil
+}
+
+// electionSet is what is loaded from the elections directory, indexed by
+// election id
+type electionSet struct {
+	configs       map[string]string
+	pubkeys       map[string]string
+	pubkeyObjects map[string][]map[string]*big.Int
+	electionCfgs  map[string]*electionCfg
+	dirs          map[string]string
+	// voter ids of the census_<election-id> files, see census.go
+	census map[string][]string
+	// secrets of the secrets_<election-id> files, see auth.go
+	secrets map[string][]string
+	// keys of the authkeys_<election-id> files, see token.go
+	authKeys map[string][]crypto.PublicKey
+	// elections that could not be loaded, with the reasons
+	loadErrors map[string][]string
+	// elections skipped because of invalid pubkeys, with the keys as decoded,
+	// so that their ballots can still be audited
+	rejected map[string]*rejectedElection
+}
+
+// rejectedElection is an election whose pubkeys failed verification
+type rejectedElection struct {
+	cfg     *electionCfg
+	pubkeys []map[string]*big.Int
+}
+
+// loadElectionDir reads the config.json, pk_<election-id>,
+// census_<election-id>, secrets_<election-id> and authkeys_<election-id>
+// files of each election directory under electionDir.
+// Elections whose files can't be read or whose pubkeys are invalid are logged
+// and skipped, the latter are also reported in loadErrors
+func loadElectionDir(electionDir string, logf func(format string, v ...interface{})) (elections *electionSet, err error) {
+	elections = &electionSet{
+		configs:       make(map[string]string),
+		pubkeys:       make(map[string]string),
+		pubkeyObjects: make(map[string][]map[string]*big.Int),
+		electionCfgs:  make(map[string]*electionCfg),
+		dirs:          make(map[string]string),
+		census:        make(map[string][]string),
+		secrets:       make(map[string][]string),
+		authKeys:      make(map[string][]crypto.PublicKey),
+		loadErrors:    make(map[string][]string),
+		rejected:      make(map[string]*rejectedElection),
+	}
+
+	files, err := ioutil.ReadDir(electionDir)
+	if err != nil {
+		logf("Could not read election dir at %s", electionDir)
+		return
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			// read config.json
+			cfgPath := path.Join(electionDir, f.Name(), "config.json")
+			var cfgText string
+			cfgText, err = util.Contents(cfgPath)
+			if err != nil {
+				logf("Could not read config.json at %s %v, skipping", cfgPath, err)
+				continue
+			} else {
+				logf("Reading %s", cfgPath)
+			}
+			var cfg map[string]*json.RawMessage
+			err = json.Unmarshal([]byte(cfgText), &cfg)
+			if err != nil {
+				logf("Error reading config file %s %v, skipping", cfgPath, err)
+				// without config the directory name is the only id at hand
+				elections.loadErrors[f.Name()] = []string{"Invalid config.json: " + err.Error()}
+				continue
+			}
+			var electionId string
+			value, ok := cfg["election-id"]
+			if !ok {
+				electionId = f.Name()
+			} else {
+				json.Unmarshal(*value, &electionId)
+			}
+
+			var eCfg *electionCfg
+			eCfg, err = parseElectionCfg(cfg)
+			if err != nil {
+				logf("Error parsing config file %s %v, skipping", cfgPath, err)
+				elections.loadErrors[electionId] = []string{"Invalid config.json: " + err.Error()}
+				continue
+			}
+			if eCfg.Hash, err = electionConfigHash(cfgText); err != nil {
+				logf("Error hashing config file %s %v, skipping", cfgPath, err)
+				elections.loadErrors[electionId] = []string{"Could not hash config.json: " + err.Error()}
+				continue
+			}
+
+			// read pk_<election-id>, an election whose pubkeys don't verify is
+			// not loaded at all
+			var keys []map[string]*big.Int
+			pkPath := path.Join(electionDir, f.Name(), "pk_"+electionId)
+			pkText, pkErr := util.Contents(pkPath)
+			if os.IsNotExist(pkErr) {
+				logf("No pubkey at %s", pkPath)
+			} else if pkErr != nil {
+				logf("Could not read pubkey at %s %v, skipping election %s", pkPath, pkErr, electionId)
+				elections.loadErrors[electionId] = []string{"Could not read pubkey: " + pkErr.Error()}
+				continue
+			} else {
+				logf("Reading %s", pkPath)
+				var diagnostics []string
+				if keys, diagnostics = parsePubkeys(pkText); diagnostics != nil {
+					for _, diagnostic := range diagnostics {
+						logf("Invalid pubkey file %s: %s", pkPath, diagnostic)
+					}
+					logf("Skipping election %s", electionId)
+					elections.loadErrors[electionId] = diagnostics
+					if keys != nil {
+						elections.rejected[electionId] = &rejectedElection{cfg: eCfg, pubkeys: keys}
+					}
+					continue
+				}
+			}
+
+			// read census_<election-id>, optional as well
+			censusPath := path.Join(electionDir, f.Name(), "census_"+electionId)
+			censusText, censusErr := util.Contents(censusPath)
+			if censusErr != nil && !os.IsNotExist(censusErr) {
+				logf("Could not read census at %s %v, skipping election %s", censusPath, censusErr, electionId)
+				elections.loadErrors[electionId] = []string{"Could not read census: " + censusErr.Error()}
+				continue
+			} else if censusErr == nil {
+				logf("Reading %s", censusPath)
+				elections.census[electionId] = parseCensus(censusText)
+			}
+
+			// read secrets_<election-id>, an election whose secrets can't be
+			// read is skipped rather than falling back to the shared secret
+			secretsPath := path.Join(electionDir, f.Name(), "secrets_"+electionId)
+			secretsText, secretsErr := util.Contents(secretsPath)
+			if secretsErr != nil && !os.IsNotExist(secretsErr) {
+				logf("Could not read secrets at %s %v, skipping election %s", secretsPath, secretsErr, electionId)
+				elections.loadErrors[electionId] = []string{"Could not read secrets: " + secretsErr.Error()}
+				continue
+			} else if secretsErr == nil {
+				secrets := parseSecrets(secretsText)
+				if len(secrets) == 0 {
+					logf("Empty secrets file %s, skipping election %s", secretsPath, electionId)
+					elections.loadErrors[electionId] = []string{"Empty secrets file"}
+					continue
+				}
+				logf("Reading %s", secretsPath)
+				elections.secrets[electionId] = secrets
+			}
+
+			// read authkeys_<election-id>, which can't be combined with secrets
+			keysPath := path.Join(electionDir, f.Name(), "authkeys_"+electionId)
+			keysText, keysErr := util.Contents(keysPath)
+			if keysErr != nil && !os.IsNotExist(keysErr) {
+				logf("Could not read auth keys at %s %v, skipping election %s", keysPath, keysErr, electionId)
+				elections.loadErrors[electionId] = []string{"Could not read auth keys: " + keysErr.Error()}
+				continue
+			} else if keysErr == nil {
+				authKeys, parseErr := parseAuthKeys(keysText)
+				if parseErr == nil && secretsErr == nil {
+					parseErr = errors.New("Election with both secrets and auth keys")
+				}
+				if parseErr != nil {
+					logf("Invalid auth keys %s %v, skipping election %s", keysPath, parseErr, electionId)
+					elections.loadErrors[electionId] = []string{"Invalid auth keys: " + parseErr.Error()}
+					continue
+				}
+				logf("Reading %s", keysPath)
+				elections.authKeys[electionId] = authKeys
+			}
+
+			logf("Loaded config file for election %s", electionId)
+			elections.configs[electionId] = cfgText
+			elections.electionCfgs[electionId] = eCfg
+			elections.dirs[electionId] = path.Join(electionDir, f.Name())
+			if keys != nil {
+				elections.pubkeys[electionId] = pkText
+				elections.pubkeyObjects[electionId] = keys
+			}
+		}
+	}
+
+	return elections, nil
+}
+
+// ElectionInfo summarizes an election directory, as shown by the admin tools
+type ElectionInfo struct {
+	Id          string `json:"election_id"`
+	Director    string `json:"director"`
+	Authorities string `json:"authorities"`
+	Pk          bool   `json:"pk"`
+	Ctexts      bool   `json:"ctexts"`
+	Tally       bool   `json:"tally"`
+	// the implicit state, the stored one is in the elections table
+	State string `json:"state"`
+	// why the election files can't be read, empty if they can
+	Error string `json:"error"`
+}
+
+func fileExists(filePath string) bool {
+	_, err := os.Stat(filePath)
+	return err == nil
+}
+
+// ListElections returns every directory of the elections directory sorted by
+// election id, including those the ballotbox would not load, with the reason
+// in Error. Only the files are read, the pubkeys are not verified, see
+// reload-config for that. implicitOpen is the ballotbox option, see
+// implicitState
+func ListElections(electionDir string, implicitOpen bool, logf func(format string, v ...interface{})) (ret []*ElectionInfo, err error) {
+	files, err := ioutil.ReadDir(electionDir)
+	if err != nil {
+		logf("Could not read election dir at %s", electionDir)
+		return
+	}
+
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		dir := path.Join(electionDir, f.Name())
+		info := &ElectionInfo{Id: f.Name()}
+		ret = append(ret, info)
+
+		cfgText, cfgErr := util.Contents(path.Join(dir, "config.json"))
+		if cfgErr != nil {
+			info.Error = "Could not read config.json: " + cfgErr.Error()
+			continue
+		}
+		var cfg struct {
+			Id          *string `json:"election-id"`
+			Director    string  `json:"director"`
+			Authorities string  `json:"authorities"`
+		}
+		if cfgErr = json.Unmarshal([]byte(cfgText), &cfg); cfgErr != nil {
+			info.Error = "Invalid config.json: " + cfgErr.Error()
+			continue
+		}
+		if cfg.Id != nil {
+			info.Id = *cfg.Id
+		}
+		info.Director = cfg.Director
+		info.Authorities = cfg.Authorities
+		info.Ctexts = fileExists(path.Join(dir, "ctexts_"+info.Id))
+		info.Tally = fileExists(path.Join(dir, info.Id+".tar.gz"))
+
+		pkText, pkErr := util.Contents(path.Join(dir, "pk_"+info.Id))
+		if pkErr == nil {
+			var pks []map[string]interface{}
+			if pkErr = json.Unmarshal([]byte(pkText), &pks); pkErr != nil {
+				info.Error = "Invalid pubkey file: " + pkErr.Error()
+			}
+		} else if !os.IsNotExist(pkErr) {
+			info.Error = "Could not read pubkey: " + pkErr.Error()
+		}
+		info.Pk = pkErr == nil
+		info.State = implicitState(info.Pk, implicitOpen)
+	}
+	sort.Sort(electionsById(ret))
+	return
+}
+
+type electionsById []*ElectionInfo
+
+func (e electionsById) Len() int           { return len(e) }
+func (e electionsById) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e electionsById) Less(i, j int) bool { return e[i].Id < e[j].Id }
@@ -0,0 +1,105 @@
+package ballotbox
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+// Ballot formats are identified by the "a" field of the encrypted vote. Each
+// format registers the function that parses its ballots, and each election
+// lists the formats it accepts in the "ballot_formats" config entry,
+// defaulting to defaultBallotFormat. New booth versions can then be rolled
+// out election by election.
+
+const defaultBallotFormat = "encrypted-vote-v1"
+
+var (
+	ErrUnknownBallotFormat     = &BallotError{"unknown-ballot-format", "Unknown ballot format"}
+	ErrBallotFormatNotAccepted = &BallotError{"ballot-format-not-accepted", "Ballot format not accepted by the election"}
+)
+
+// ballot is a parsed encrypted vote of any format
+type ballot interface {
+	// validate checks the ballot against the election pubkeys and config, as
+	// EncryptedVote.validate
+	validate(electionPks []map[string]*big.Int, checkResidues bool, eCfg *electionCfg, verifier popkVerifier) error
+	// Marshal returns the canonical json of the ballot, which is stored and
+	// must match the vote hash
+	Marshal() ([]byte, error)
+}
+
+// ballotParser decodes the json of a ballot of its format
+type ballotParser func(data []byte) (ballot, error)
+
+var ballotFormats = make(map[string]ballotParser)
+
+// registerBallotFormat makes the format with the given "a" value available to
+// elections, it is meant to be called from init functions
+func registerBallotFormat(a string, parser ballotParser) {
+	if _, ok := ballotFormats[a]; ok {
+		panic("Ballot format registered twice: " + a)
+	}
+	ballotFormats[a] = parser
+}
+
+func init() {
+	registerBallotFormat(defaultBallotFormat, func(data []byte) (ballot, error) {
+		v, err := ParseEncryptedVote(data)
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	})
+}
+
+// parseBallot parses the ballot with the parser of its format, which must be
+// accepted by the election. eCfg may be nil to accept the default format only
+func parseBallot(data []byte, eCfg *electionCfg) (ballot, error) {
+	var header struct {
+		A string `json:"a"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	parser, ok := ballotFormats[header.A]
+	if !ok {
+		return nil, ErrUnknownBallotFormat
+	}
+	if !eCfg.acceptsFormat(header.A) {
+		return nil, ErrBallotFormatNotAccepted
+	}
+	return parser(data)
+}
+
+// checkBallotShape makes the checks shared by all the formats: the election
+// hash, the issue date, and one choice and one proof per question and pubkey
+func checkBallotShape(electionHash *ElectionHash, issueDate string, numChoices int, numProofs int, numPks int, eCfg *electionCfg) error {
+	if electionHash == nil {
+		return errors.New("Missing election hash")
+	}
+
+	if electionHash.A != "hash/sha256/value" {
+		return errors.New("Unexpected a value on election hash")
+	}
+
+	if expected := eCfg.expectedHash(); expected != "" && electionHash.Value != expected {
+		return ErrElectionHashMismatch
+	}
+
+	if issueDate == "" {
+		return errors.New("Missing issue date")
+	}
+
+	// one choice per question, each encrypted with its own pubkey
+	if numChoices != numPks {
+		return ErrInvalidChoicesCount
+	}
+	if numQuestions := eCfg.numQuestions(); numQuestions > 0 && numChoices != numQuestions {
+		return ErrInvalidChoicesCount
+	}
+	if numProofs != numChoices {
+		return ErrInvalidProofsCount
+	}
+	return nil
+}
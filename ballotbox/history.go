@@ -0,0 +1,55 @@
+package ballotbox
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/agoravoting/agora-http-go/middleware"
+	"github.com/julienschmidt/httprouter"
+)
+
+// CastRecord is one accepted cast of a voter. The votes table only holds the
+// current ballot, every cast is kept in vote_history so that earlier receipts
+// can still be checked
+type CastRecord struct {
+	VoteHash   string    `json:"vote_hash" db:"vote_hash"`
+	Vote       string    `json:"vote,omitempty" db:"vote"`
+	Ip         string    `json:"ip" db:"ip"`
+	Created    time.Time `json:"created" db:"created"`
+	WriteCount int64     `json:"write_count" db:"write_count"`
+	// false for the re-casts of first-vote-counts elections, see revote.go
+	Counted bool `json:"counted" db:"counted"`
+}
+
+// getVoterHistory lists the casts of a voter, oldest first, for dispute
+// resolution. ?ciphertexts=true includes the encrypted votes
+func (bb *BallotBox) getVoterHistory(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+	var err error
+
+	electionId := p.ByName("election_id")
+	voterId := p.ByName("voter_id")
+	if electionId == "" {
+		return &middleware.HandledError{Err: err, Code: 400, Message: "No election_id", CodedMessage: "empty-election-id"}
+	}
+	if voterId == "" {
+		return &middleware.HandledError{Err: err, Code: 400, Message: "No voter_id", CodedMessage: "empty-voter-id"}
+	}
+	if _, ok := bb.configs[electionId]; !ok {
+		return &middleware.HandledError{Err: err, Code: 404, Message: "Election not found", CodedMessage: "election-not-found"}
+	}
+
+	casts, err := bb.store.VoteHistory(electionId, voterId)
+	if err != nil {
+		return &middleware.HandledError{Err: err, Code: 500, Message: "Database error", CodedMessage: "error-select"}
+	}
+	if r.URL.Query().Get("ciphertexts") != "true" {
+		for _, c := range casts {
+			c.Vote = ""
+		}
+	}
+	if casts == nil {
+		casts = []*CastRecord{}
+	}
+
+	return writeJson(w, http.StatusOK, map[string]interface{}{"election_id": electionId, "voter_id": voterId, "casts": casts})
+}
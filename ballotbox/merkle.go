@@ -0,0 +1,308 @@
+package ballotbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/agoravoting/agora-http-go/middleware"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Each election keeps a merkle tree whose leaves are the hashes of the
+// currently counted ballots ordered by votes.id, the same set and order as the
+// bulletin board. A voter re-casting replaces its leaf, a new voter appends
+// one. Leaves are sha256(0x00 || vote_hash) and nodes sha256(0x01 || left ||
+// right), a node without right sibling is promoted unchanged to the next level.
+//
+// The tree only sees the votes cast through this process, other writers are
+// picked up when it is rebuilt on reload-config. Several ballotbox instances
+// sharing a store would each publish a different root, so the merkle routes
+// must be served by a single instance.
+
+type merkleTree struct {
+	mutex sync.Mutex
+	// levels[0] are the leaves, the last level holds the root
+	levels     [][][]byte
+	voteHashes []string
+	// votes.id and vote_hash -> leaf index
+	positions map[int64]int
+	hashes    map[string]int
+	lastId    int64
+	// set when a vote can't be added in order, the tree must be rebuilt
+	dirty bool
+}
+
+// MerkleProofStep is a sibling hash in an inclusion proof, side tells
+// whether the sibling goes to the left or the right of the computed hash
+type MerkleProofStep struct {
+	Hash string `json:"hash"`
+	Side string `json:"side"`
+}
+
+// MerkleRoot is the signed commitment to the ballot set of an election
+type MerkleRoot struct {
+	ElectionId string `json:"election_id"`
+	Root       string `json:"root"`
+	Size       int    `json:"size"`
+	Timestamp  int64  `json:"timestamp"`
+	Signature  string `json:"signature"`
+}
+
+type InclusionProof struct {
+	VoteHash  string             `json:"vote_hash"`
+	LeafIndex int                `json:"leaf_index"`
+	Path      []*MerkleProofStep `json:"path"`
+	Root      *MerkleRoot        `json:"root"`
+}
+
+func merkleLeafHash(voteHash string) []byte {
+	h256 := sha256.New()
+	h256.Write([]byte{0})
+	h256.Write([]byte(voteHash))
+	return h256.Sum(nil)
+}
+
+func merkleNodeHash(left []byte, right []byte) []byte {
+	h256 := sha256.New()
+	h256.Write([]byte{1})
+	h256.Write(left)
+	h256.Write(right)
+	return h256.Sum(nil)
+}
+
+func newMerkleTree() *merkleTree {
+	t := &merkleTree{}
+	t.reset()
+	return t
+}
+
+// reset empties the tree
+func (t *merkleTree) reset() {
+	t.levels = [][][]byte{nil}
+	t.voteHashes = nil
+	t.positions = make(map[int64]int)
+	t.hashes = make(map[string]int)
+	t.lastId = 0
+	t.dirty = false
+}
+
+// set adds the ballot with the given votes.id, or replaces it if the voter
+// already had one
+func (t *merkleTree) set(id int64, voteHash string) {
+	if index, ok := t.positions[id]; ok {
+		delete(t.hashes, t.voteHashes[index])
+		t.voteHashes[index] = voteHash
+		t.hashes[voteHash] = index
+		t.levels[0][index] = merkleLeafHash(voteHash)
+		t.recompute(index)
+		return
+	}
+	if id < t.lastId {
+		t.dirty = true
+		return
+	}
+
+	index := len(t.voteHashes)
+	t.positions[id] = index
+	t.hashes[voteHash] = index
+	t.voteHashes = append(t.voteHashes, voteHash)
+	t.levels[0] = append(t.levels[0], merkleLeafHash(voteHash))
+	t.lastId = id
+	t.recompute(index)
+}
+
+// recompute updates the path from the leaf at index to the root
+func (t *merkleTree) recompute(index int) {
+	for level := 0; len(t.levels[level]) > 1; level++ {
+		if level+1 == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+		nodes := t.levels[level]
+		left := index &^ 1
+		node := nodes[left]
+		if left+1 < len(nodes) {
+			node = merkleNodeHash(nodes[left], nodes[left+1])
+		}
+		index /= 2
+		if index < len(t.levels[level+1]) {
+			t.levels[level+1][index] = node
+		} else {
+			t.levels[level+1] = append(t.levels[level+1], node)
+		}
+	}
+}
+
+func (t *merkleTree) size() int {
+	return len(t.voteHashes)
+}
+
+// root returns the hex encoded root, empty if there are no ballots
+func (t *merkleTree) root() string {
+	top := t.levels[len(t.levels)-1]
+	if len(top) == 0 {
+		return ""
+	}
+	return hex.EncodeToString(top[0])
+}
+
+func (t *merkleTree) proof(voteHash string) (index int, path []*MerkleProofStep, ok bool) {
+	index, ok = t.hashes[voteHash]
+	if !ok {
+		return
+	}
+	path = []*MerkleProofStep{}
+	position := index
+	for level := 0; level < len(t.levels)-1; level++ {
+		sibling := position ^ 1
+		if sibling < len(t.levels[level]) {
+			side := "right"
+			if sibling < position {
+				side = "left"
+			}
+			path = append(path, &MerkleProofStep{Hash: hex.EncodeToString(t.levels[level][sibling]), Side: side})
+		}
+		position /= 2
+	}
+	return
+}
+
+// VerifyInclusionProof checks that the path leads from voteHash to root
+func VerifyInclusionProof(voteHash string, path []*MerkleProofStep, root string) bool {
+	hash := merkleLeafHash(voteHash)
+	for _, step := range path {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return false
+		}
+		switch step.Side {
+		case "left":
+			hash = merkleNodeHash(sibling, hash)
+		case "right":
+			hash = merkleNodeHash(hash, sibling)
+		default:
+			return false
+		}
+	}
+	return hex.EncodeToString(hash) == root
+}
+
+// message returns the signed content of a merkle root
+func (m *MerkleRoot) message() string {
+	return fmt.Sprintf("merkle-root/%s/%d/%s/%d", m.ElectionId, m.Size, m.Root, m.Timestamp)
+}
+
+// build reads the counted ballots of an election from the store, the tree
+// must be locked
+func (t *merkleTree) build(store VoteStore, electionId string) (err error) {
+	t.reset()
+	err = store.IterateVotes(electionId, 0, 0, false, func(v *Vote) error {
+		t.set(v.Id, v.VoteHash)
+		return nil
+	})
+	if err != nil {
+		// built again on next use
+		t.dirty = true
+	}
+	return
+}
+
+// merkleTree returns the locked tree of an election, building it if needed.
+// The caller must unlock it. The store is read holding only the lock of the
+// election tree, so other elections are not blocked by the build, and votes
+// cast meanwhile wait for it in addToMerkleTree
+func (bb *BallotBox) merkleTree(electionId string) (*merkleTree, error) {
+	bb.merkleMutex.Lock()
+	t, ok := bb.merkleTrees[electionId]
+	if !ok {
+		t = newMerkleTree()
+		t.dirty = true
+		bb.merkleTrees[electionId] = t
+	}
+	bb.merkleMutex.Unlock()
+
+	t.mutex.Lock()
+	if t.dirty {
+		if err := t.build(bb.store, electionId); err != nil {
+			t.mutex.Unlock()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// addToMerkleTree records a cast vote in the election tree, if it was built
+func (bb *BallotBox) addToMerkleTree(electionId string, id int64, voteHash string) {
+	bb.merkleMutex.Lock()
+	t, ok := bb.merkleTrees[electionId]
+	bb.merkleMutex.Unlock()
+	if !ok {
+		return
+	}
+	t.mutex.Lock()
+	t.set(id, voteHash)
+	t.mutex.Unlock()
+}
+
+func (bb *BallotBox) signedMerkleRoot(electionId string, t *merkleTree) *MerkleRoot {
+	root := &MerkleRoot{
+		ElectionId: electionId,
+		Root:       t.root(),
+		Size:       t.size(),
+		Timestamp:  bb.clock().Unix(),
+	}
+	root.Signature = bb.sign(root.message())
+	return root
+}
+
+func (bb *BallotBox) getMerkleRoot(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+	var err error
+
+	electionId := p.ByName("election_id")
+	if electionId == "" {
+		return &middleware.HandledError{Err: err, Code: 400, Message: "No election_id", CodedMessage: "empty-election-id"}
+	}
+	if hErr := bb.checkElectionStarted(electionId); hErr != nil {
+		return hErr
+	}
+
+	t, err := bb.merkleTree(electionId)
+	if err != nil {
+		return &middleware.HandledError{Err: err, Code: 500, Message: "Database error", CodedMessage: "error-select"}
+	}
+	root := bb.signedMerkleRoot(electionId, t)
+	t.mutex.Unlock()
+
+	return writeJson(w, http.StatusOK, root)
+}
+
+func (bb *BallotBox) getInclusionProof(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+	var err error
+
+	electionId := p.ByName("election_id")
+	voteHash := p.ByName("vote_hash")
+	if electionId == "" {
+		return &middleware.HandledError{Err: err, Code: 400, Message: "No election_id", CodedMessage: "empty-election-id"}
+	}
+	if voteHash == "" {
+		return &middleware.HandledError{Err: err, Code: 400, Message: "Invalid hash format", CodedMessage: "invalid-format"}
+	}
+	if hErr := bb.checkElectionStarted(electionId); hErr != nil {
+		return hErr
+	}
+
+	t, err := bb.merkleTree(electionId)
+	if err != nil {
+		return &middleware.HandledError{Err: err, Code: 500, Message: "Database error", CodedMessage: "error-select"}
+	}
+	index, path, ok := t.proof(voteHash)
+	root := bb.signedMerkleRoot(electionId, t)
+	t.mutex.Unlock()
+	if !ok {
+		return &middleware.HandledError{Err: err, Code: 404, Message: "Not found", CodedMessage: "not-found"}
+	}
+
+	return writeJson(w, http.StatusOK, &InclusionProof{VoteHash: voteHash, LeafIndex: index, Path: path, Root: root})
+}
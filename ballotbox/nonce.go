@@ -0,0 +1,61 @@
+package ballotbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/agoravoting/agora-http-go/middleware"
+	s "github.com/agoravoting/agora-http-go/server"
+)
+
+// An election with
+//
+//	"one_time_tokens": true
+//
+// in its config.json only accepts voter tokens with a nonce, the
+// <perm>:<timestamp>:<nonce>:<hmac> HMAC headers or signed tokens with a
+// jti, and each nonce only once, so that a captured token can't be replayed.
+// Used nonces are kept in the vote store until their token expires, HMAC
+// tokens without ballotboxSessionExpire keep theirs for good. Only the
+// requests that cast a vote use them up, and the nonce is released if the
+// request fails so that the voter can retry with the same token. Reads like
+// check-hash don't check nonces
+
+// limit of the nonce length
+const nonceMaxSize = 128
+
+// NewNonce returns a random nonce for one-time tokens
+func NewNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// checkNonce consumes the nonce of a valid voter token if the election uses
+// one-time tokens, returning whether it did
+func (bb *BallotBox) checkNonce(electionId string, token *voterToken) (bool, *middleware.HandledError) {
+	eCfg, ok := bb.electionCfgs[electionId]
+	if !ok || !eCfg.OneTimeTokens {
+		return false, nil
+	}
+	if token.Nonce == "" || len(token.Nonce) > nonceMaxSize {
+		return false, &middleware.HandledError{Code: 403, Message: "One-time voter token required", CodedMessage: "nonce-required"}
+	}
+	fresh, err := bb.store.UseNonce(electionId, token.Nonce, token.Expires)
+	if err != nil {
+		return false, &middleware.HandledError{Err: err, Code: 500, Message: "Error recording the nonce", CodedMessage: "error-insert"}
+	}
+	if !fresh {
+		return false, &middleware.HandledError{Code: 403, Message: "Voter token already used", CodedMessage: "token-reused"}
+	}
+	return true, nil
+}
+
+// releaseNonce gives back the nonce of a token whose request failed
+func (bb *BallotBox) releaseNonce(electionId string, token *voterToken) {
+	if err := bb.store.ReleaseNonce(electionId, token.Nonce); err != nil {
+		s.Server.Logger.Printf("Error releasing nonce of election %s: %v", electionId, err)
+	}
+}
@@ -0,0 +1,114 @@
+package ballotbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// minimum size in bits of the ElGamal modulus p
+const minPubkeyBits = 2048
+
+// Miller-Rabin rounds used when checking p and q, on top of Baillie-PSW
+const primalityRounds = 20
+
+var (
+	bigOne = big.NewInt(1)
+	bigTwo = big.NewInt(2)
+)
+
+// parsePubkeys decodes the contents of a pk_<election-id> file and verifies
+// each key, see verifyPubkey, or decodeCurvePubkey for keys with a "curve".
+// All the keys are checked, and one diagnostic is returned for each invalid one.
+// The keys that could be decoded are returned along with the diagnostics, nil
+// in place of those that could not, so that the audit can still use them
+func parsePubkeys(pkText string) (keys []map[string]*big.Int, diagnostics []string) {
+	var pksDecoded []map[string]interface{}
+	if err := json.Unmarshal([]byte(pkText), &pksDecoded); err != nil {
+		return nil, []string{"Error decoding pubkeys: " + err.Error()}
+	}
+	if len(pksDecoded) == 0 {
+		return nil, []string{"No pubkeys"}
+	}
+
+	// every question usually shares the same group, check it only once
+	verifiedGroups := make(map[string]bool)
+	keys = make([]map[string]*big.Int, len(pksDecoded))
+	for index, element := range pksDecoded {
+		var (
+			key map[string]*big.Int
+			err error
+		)
+		if _, ok := element["curve"]; ok {
+			key, err = decodeCurvePubkey(element)
+		} else if key, err = decodePubkey(element); err == nil {
+			err = verifyPubkey(key, verifiedGroups)
+		}
+		if err != nil {
+			diagnostics = append(diagnostics, fmt.Sprintf("pk %d: %v", index, err))
+		}
+		keys[index] = key
+	}
+	return keys, diagnostics
+}
+
+// decodePubkey reads the decimal p, q, g and y values of a key
+func decodePubkey(element map[string]interface{}) (key map[string]*big.Int, err error) {
+	if element == nil {
+		return nil, fmt.Errorf("empty key")
+	}
+	key = make(map[string]*big.Int)
+	for _, name := range []string{"p", "q", "g", "y"} {
+		str, ok := element[name].(string)
+		if !ok {
+			return nil, fmt.Errorf("missing %s", name)
+		}
+		value, ok := new(big.Int).SetString(str, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s", name)
+		}
+		key[name] = value
+	}
+	return
+}
+
+// verifyPubkey checks that p = 2q + 1 is a safe prime of at least
+// minPubkeyBits, that g generates the subgroup of order q and that y belongs
+// to it. verifiedGroups caches the (p, g) pairs already checked
+func verifyPubkey(key map[string]*big.Int, verifiedGroups map[string]bool) error {
+	p, q, g, y := key["p"], key["q"], key["g"], key["y"]
+
+	group := p.String() + "/" + g.String()
+	if !verifiedGroups[group] {
+		if p.BitLen() < minPubkeyBits {
+			return fmt.Errorf("p is %d bits, at least %d required", p.BitLen(), minPubkeyBits)
+		}
+		if new(big.Int).Add(new(big.Int).Mul(q, bigTwo), bigOne).Cmp(p) != 0 {
+			return fmt.Errorf("p is not 2q + 1")
+		}
+		if !q.ProbablyPrime(primalityRounds) {
+			return fmt.Errorf("q is not prime")
+		}
+		if !p.ProbablyPrime(primalityRounds) {
+			return fmt.Errorf("p is not prime")
+		}
+		if !inSubgroup(g, p, q) || g.Cmp(bigOne) == 0 {
+			return fmt.Errorf("g does not generate the order q subgroup")
+		}
+		verifiedGroups[group] = true
+	}
+
+	if !inSubgroup(y, p, q) || y.Cmp(bigOne) == 0 {
+		return fmt.Errorf("y is not in the order q subgroup")
+	}
+	return nil
+}
+
+// inSubgroup returns whether 0 < value < p and value^q = 1 mod p. Being q
+// prime, any such value other than 1 generates the subgroup
+func inSubgroup(value *big.Int, p *big.Int, q *big.Int) bool {
+	if value.Sign() <= 0 || value.Cmp(p) >= 0 {
+		return false
+	}
+	return new(big.Int).Exp(value, q, p).Cmp(bigOne) == 0
+}
@@ -0,0 +1,285 @@
+package ballotbox
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// The encrypted-vote-v2 format encrypts every answer of a question on its own
+// with exponential ElGamal, beta = g^m * y^k, where m is 1 if the answer is
+// selected and 0 otherwise:
+//
+//	{"a": "encrypted-vote-v2",
+//	 "choices": [{"selections": [{"alpha": <int>, "beta": <int>}, ...]}, ...],
+//	 "proofs": [{"selections": [<range proof>, ...], "sum": <range proof>}, ...],
+//	 "election_hash": ..., "issue_date": ...}
+//
+// with one choice and one proof per question, and one selection per answer.
+// Each selection proof shows m is 0 or 1, and the sum proof that the
+// product of the selections of the question, which encrypts the number of
+// selected answers, is within the question min and max.
+//
+// A range proof is a disjunctive Chaum-Pedersen proof that (alpha, beta)
+// encrypts one of the values m_0 ... m_n-1:
+//
+//	{"commitments": [{"a": <int>, "b": <int>}, ...], "challenges": [<int>, ...], "responses": [<int>, ...]}
+//
+// with one commitment, challenge and response per value. It is valid if
+//
+//	sum(challenges) = sha256(p/q/g/y/n/m_0/.../m_n-1/alpha/beta/a_0/b_0/.../a_n-1/b_n-1) mod q
+//	g^response_j = a_j * alpha^challenge_j mod p
+//	y^response_j = b_j * (beta / g^m_j)^challenge_j mod p
+//
+// where the hashed values are written in decimal. The challenge covers the
+// whole statement, the group, the pubkey, the ciphertext and the allowed
+// values, before the commitments. The proofs also prove knowledge of the
+// randomness, so there are no separate proofs of knowledge.
+
+const rangeBallotFormat = "encrypted-vote-v2"
+
+var (
+	ErrInvalidSelectionsCount = &BallotError{"invalid-selections-count", "Number of selections doesn't match the question answers"}
+	ErrMissingQuestions       = &BallotError{"missing-questions", "The election has no questions_data to check the ballot against"}
+	ErrInvalidQuestionRange   = &BallotError{"invalid-question-range", "The question min and max allow no answer"}
+)
+
+type EncryptedVoteV2 struct {
+	A            string           `json:"a"`
+	Choices      []*ChoiceV2      `json:"choices"`
+	ElectionHash *ElectionHash    `json:"election_hash"`
+	IssueDate    string           `json:"issue_date"`
+	Proofs       []*QuestionProof `json:"proofs"`
+}
+
+// ChoiceV2 holds the encrypted selections of the answers of a question
+type ChoiceV2 struct {
+	Selections []*Choice `json:"selections"`
+}
+
+type QuestionProof struct {
+	Selections []*RangeProof `json:"selections"`
+	Sum        *RangeProof   `json:"sum"`
+}
+
+type RangeProof struct {
+	Commitments []*RangeCommitment `json:"commitments"`
+	Challenges  []string           `json:"challenges"`
+	Responses   []string           `json:"responses"`
+}
+
+type RangeCommitment struct {
+	A string `json:"a"`
+	B string `json:"b"`
+}
+
+// rangeCheck is the verification of one range proof
+type rangeCheck struct {
+	pk          map[string]*big.Int
+	alpha       *big.Int
+	beta        *big.Int
+	values      []int
+	commitments [][2]*big.Int
+	challenges  []*big.Int
+	responses   []*big.Int
+}
+
+func init() {
+	registerBallotFormat(rangeBallotFormat, func(data []byte) (ballot, error) {
+		v := &EncryptedVoteV2{}
+		if err := json.Unmarshal(data, v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	})
+}
+
+func parseInt(str string, name string) (*big.Int, error) {
+	value, ok := new(big.Int).SetString(str, 10)
+	if !ok {
+		return nil, errors.New("Error parsing " + name)
+	}
+	return value, nil
+}
+
+// check parses the proof that (alpha, beta) encrypts one of values
+func (r *RangeProof) check(pk map[string]*big.Int, alpha *big.Int, beta *big.Int, values []int) (check *rangeCheck, err error) {
+	if r == nil {
+		return nil, ErrMissingProof
+	}
+	if len(r.Commitments) != len(values) || len(r.Challenges) != len(values) || len(r.Responses) != len(values) {
+		return nil, errors.New("Unexpected range proof length")
+	}
+	check = &rangeCheck{pk: pk, alpha: alpha, beta: beta, values: values}
+	for j := range values {
+		commitment := r.Commitments[j]
+		if commitment == nil {
+			return nil, ErrMissingProof
+		}
+		var a, b, challenge, response *big.Int
+		if a, err = parseInt(commitment.A, "commitment"); err != nil {
+			return
+		}
+		if b, err = parseInt(commitment.B, "commitment"); err != nil {
+			return
+		}
+		if challenge, err = parseInt(r.Challenges[j], "challenge"); err != nil {
+			return
+		}
+		if response, err = parseInt(r.Responses[j], "response"); err != nil {
+			return
+		}
+		check.commitments = append(check.commitments, [2]*big.Int{a, b})
+		check.challenges = append(check.challenges, challenge)
+		check.responses = append(check.responses, response)
+	}
+	return
+}
+
+// rangeChallenge returns the expected sum of the challenges of a range proof
+// that (alpha, beta) encrypts one of values
+func rangeChallenge(pk map[string]*big.Int, values []int, alpha *big.Int, beta *big.Int, commitments [][2]*big.Int) *big.Int {
+	h256 := sha256.New()
+	fmt.Fprintf(h256, "%s/%s/%s/%s/%d", pk["p"], pk["q"], pk["g"], pk["y"], len(values))
+	for _, value := range values {
+		fmt.Fprintf(h256, "/%d", value)
+	}
+	fmt.Fprintf(h256, "/%s/%s", alpha, beta)
+	for _, commitment := range commitments {
+		fmt.Fprintf(h256, "/%s/%s", commitment[0], commitment[1])
+	}
+	expected := new(big.Int).SetBytes(h256.Sum(nil))
+	return expected.Mod(expected, pk["q"])
+}
+
+func (c *rangeCheck) verify() bool {
+	p, q, g, y := c.pk["p"], c.pk["q"], c.pk["g"], c.pk["y"]
+
+	sum := new(big.Int)
+	lhs := new(big.Int)
+	rhs := new(big.Int)
+	for j, value := range c.values {
+		a, b := c.commitments[j][0], c.commitments[j][1]
+		challenge, response := c.challenges[j], c.responses[j]
+		sum.Add(sum, challenge)
+
+		lhs.Exp(g, response, p)
+		rhs.Exp(c.alpha, challenge, p)
+		rhs.Mul(rhs, a)
+		rhs.Mod(rhs, p)
+		if lhs.Cmp(rhs) != 0 {
+			return false
+		}
+
+		// beta / g^m
+		rhs.Exp(g, big.NewInt(int64(value)), p)
+		if rhs.ModInverse(rhs, p) == nil {
+			return false
+		}
+		rhs.Mul(rhs, c.beta)
+		rhs.Mod(rhs, p)
+		rhs.Exp(rhs, challenge, p)
+		rhs.Mul(rhs, b)
+		rhs.Mod(rhs, p)
+		lhs.Exp(y, response, p)
+		if lhs.Cmp(rhs) != 0 {
+			return false
+		}
+	}
+	sum.Mod(sum, q)
+	return sum.Cmp(rangeChallenge(c.pk, c.values, c.alpha, c.beta, c.commitments)) == 0
+}
+
+// selectionRange returns the allowed numbers of selected answers, from min to
+// max bounded by the number of answers
+func (q *questionCfg) selectionRange() []int {
+	min, max := q.Min, q.Max
+	if min < 0 {
+		min = 0
+	}
+	if max > q.NumAnswers {
+		max = q.NumAnswers
+	}
+	values := []int{}
+	for value := min; value <= max; value++ {
+		values = append(values, value)
+	}
+	return values
+}
+
+// validate checks the ballot against the election pubkeys and the questions
+// of the election config, which is required. Selections are always checked
+// to be quadratic residues, the proofs are not sound otherwise
+func (e *EncryptedVoteV2) validate(electionPks []map[string]*big.Int, checkResidues bool, eCfg *electionCfg, verifier popkVerifier) (err error) {
+	if e.A != rangeBallotFormat {
+		return errors.New("Unexpected a value")
+	}
+	if err = checkBallotShape(e.ElectionHash, e.IssueDate, len(e.Choices), len(e.Proofs), len(electionPks), eCfg); err != nil {
+		return err
+	}
+	if eCfg == nil || len(eCfg.Questions) == 0 {
+		return ErrMissingQuestions
+	}
+
+	var checks []proofCheck
+	for index, choice := range e.Choices {
+		pk := electionPks[index]
+		if pk == nil || pk["p"] == nil || pk["q"] == nil || pk["g"] == nil || pk["y"] == nil {
+			return ErrInvalidPubkey
+		}
+		if choice == nil {
+			return ErrMissingChoice
+		}
+		proof := e.Proofs[index]
+		if proof == nil {
+			return ErrMissingProof
+		}
+		question := eCfg.Questions[index]
+		if len(choice.Selections) != question.NumAnswers {
+			return ErrInvalidSelectionsCount
+		}
+		if len(proof.Selections) != len(choice.Selections) {
+			return ErrInvalidProofsCount
+		}
+
+		// the product of the selections encrypts the number of selected answers
+		p := pk["p"]
+		sumAlpha, sumBeta := big.NewInt(1), big.NewInt(1)
+		for i, selection := range choice.Selections {
+			if selection == nil {
+				return ErrMissingChoice
+			}
+			if err = selection.validate(pk); err != nil {
+				return err
+			}
+			var check *rangeCheck
+			if check, err = proof.Selections[i].check(pk, selection.Alpha, selection.Beta, []int{0, 1}); err != nil {
+				return err
+			}
+			checks = append(checks, check)
+			sumAlpha.Mul(sumAlpha, selection.Alpha).Mod(sumAlpha, p)
+			sumBeta.Mul(sumBeta, selection.Beta).Mod(sumBeta, p)
+		}
+
+		values := question.selectionRange()
+		if len(values) == 0 {
+			return ErrInvalidQuestionRange
+		}
+		var check *rangeCheck
+		if check, err = proof.Sum.check(pk, sumAlpha, sumBeta, values); err != nil {
+			return err
+		}
+		checks = append(checks, check)
+	}
+
+	if verifier == nil {
+		verifier = sequentialVerifier{}
+	}
+	return verifier.verify(checks)
+}
+
+func (e *EncryptedVoteV2) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
@@ -0,0 +1,122 @@
+package ballotbox
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// re-vote policy modes, set per election with
+//
+//	"revote_policy": {"mode": <mode>, "max_writes": <n>, "cooldown": <seconds>}
+//
+// in its config.json. Elections without one use last-vote-counts with the
+// server maxWrites
+const (
+	// only one cast is accepted
+	RevoteSingleCast = "single-cast"
+	// each re-cast replaces the counted ballot, up to max_writes casts
+	RevoteLastCounts = "last-vote-counts"
+	// re-casts are kept in the vote history, up to max_writes casts, but the
+	// counted ballot is always the first one
+	RevoteFirstCounts = "first-vote-counts"
+	// any number of re-casts
+	RevoteUnlimited = "unlimited"
+)
+
+// revotePolicy is the parsed revote_policy of an election
+type revotePolicy struct {
+	Mode string
+	// total casts allowed including the first, 0 uses the server maxWrites.
+	// Ignored by single-cast and unlimited
+	MaxWrites int
+	// minimum time between two casts of a voter
+	Cooldown time.Duration
+}
+
+// CastLimits restricts the casts of a voter, see VoteStore.CastVote
+type CastLimits struct {
+	// maximum number of casts including the first, 0 means no limit
+	MaxWrites int
+	// minimum time since the previous cast
+	Cooldown time.Duration
+	// re-casts are only recorded in the vote history, the first ballot stays
+	// counted
+	KeepFirst bool
+}
+
+// CastResult is the outcome of VoteStore.CastVote
+type CastResult string
+
+const (
+	// the ballot is now the counted one of the voter
+	CastStored CastResult = "stored"
+	// the vote hash belongs to another voter, nothing is stored
+	CastHashTaken CastResult = "hash-taken"
+	// the voter reached the maximum number of casts, nothing is stored
+	CastMaxWrites CastResult = "max-writes"
+	// the previous cast is too recent, nothing is stored
+	CastCooldown CastResult = "cooldown"
+	// the ballot was added to the vote history but is not counted
+	CastRecorded CastResult = "recorded"
+)
+
+// parseRevotePolicy reads the optional revote_policy of an election config,
+// nil if there is none
+func parseRevotePolicy(cfg map[string]*json.RawMessage) (*revotePolicy, error) {
+	value, ok := cfg["revote_policy"]
+	if !ok || value == nil {
+		return nil, nil
+	}
+	var policy struct {
+		Mode      string `json:"mode"`
+		MaxWrites int    `json:"max_writes"`
+		Cooldown  int    `json:"cooldown"`
+	}
+	if err := json.Unmarshal(*value, &policy); err != nil {
+		return nil, err
+	}
+	switch policy.Mode {
+	case RevoteSingleCast, RevoteLastCounts, RevoteFirstCounts, RevoteUnlimited:
+	default:
+		return nil, errors.New("Unknown revote_policy mode " + policy.Mode)
+	}
+	if policy.MaxWrites < 0 || policy.Cooldown < 0 {
+		return nil, errors.New("Negative revote_policy value")
+	}
+	return &revotePolicy{policy.Mode, policy.MaxWrites, time.Duration(policy.Cooldown) * time.Second}, nil
+}
+
+// castLimits returns the limits of the election re-vote policy, maxWrites is
+// the server default
+func (e *electionCfg) castLimits(maxWrites int) CastLimits {
+	if e == nil || e.RevotePolicy == nil {
+		return CastLimits{MaxWrites: maxWrites}
+	}
+	policy := e.RevotePolicy
+	limits := CastLimits{MaxWrites: maxWrites, Cooldown: policy.Cooldown}
+	if policy.MaxWrites > 0 {
+		limits.MaxWrites = policy.MaxWrites
+	}
+	switch policy.Mode {
+	case RevoteSingleCast:
+		limits.MaxWrites = 1
+	case RevoteFirstCounts:
+		limits.KeepFirst = true
+	case RevoteUnlimited:
+		limits.MaxWrites = 0
+	}
+	return limits
+}
+
+// allows returns whether limits allow another cast of a voter with
+// writeCount casts, the last one at lastCast
+func (l CastLimits) allows(writeCount int64, lastCast time.Time, now time.Time) CastResult {
+	if l.MaxWrites > 0 && writeCount >= int64(l.MaxWrites) {
+		return CastMaxWrites
+	}
+	if l.Cooldown > 0 && now.Sub(lastCast) < l.Cooldown {
+		return CastCooldown
+	}
+	return CastStored
+}
@@ -0,0 +1,109 @@
+package ballotbox
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/agoravoting/agora-http-go/middleware"
+	s "github.com/agoravoting/agora-http-go/server"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Receipt is returned to the voter when a ballot is accepted, it is signed
+// with the server key so that the voter can later prove the cast
+type Receipt struct {
+	ElectionId string `json:"election_id"`
+	VoteHash   string `json:"vote_hash"`
+	Timestamp  int64  `json:"timestamp"`
+	WriteCount int64  `json:"write_count"`
+	Signature  string `json:"signature"`
+}
+
+// message returns the signed content of a receipt
+func (r *Receipt) message() string {
+	return fmt.Sprintf("receipt/%s/%s/%d/%d", r.ElectionId, r.VoteHash, r.Timestamp, r.WriteCount)
+}
+
+// VerifyReceipt checks the receipt signature against the server public key
+// published at /signing-key
+func VerifyReceipt(publicKey ed25519.PublicKey, receipt *Receipt) bool {
+	return verifySignature(publicKey, receipt.message(), receipt.Signature)
+}
+
+// loadSigningKey reads the server Ed25519 signing key from the "signingKey"
+// config entry, a base64 encoded 32 byte seed or 64 byte private key. It is
+// required, unless "temporarySigningKey" is true, for development, in which
+// case a new key is generated that will change on restart
+func loadSigningKey(cfg map[string]*json.RawMessage) (key ed25519.PrivateKey, err error) {
+	var encoded string
+	if value, ok := cfg["signingKey"]; ok && value != nil {
+		if err = json.Unmarshal(*value, &encoded); err != nil {
+			return
+		}
+	}
+	if encoded == "" {
+		var temporary bool
+		if value, ok := cfg["temporarySigningKey"]; ok && value != nil {
+			json.Unmarshal(*value, &temporary)
+		}
+		if !temporary {
+			err = errors.New("No signingKey configured")
+			return
+		}
+		s.Server.Logger.Printf("No signingKey configured, using a temporary signing key")
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+		return
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return
+	}
+	switch len(raw) {
+	case ed25519.SeedSize:
+		key = ed25519.NewKeyFromSeed(raw)
+	case ed25519.PrivateKeySize:
+		key = ed25519.PrivateKey(raw)
+	default:
+		err = errors.New("Invalid signingKey length")
+	}
+	return
+}
+
+// sign returns the base64 encoded signature of message with the server key
+func (bb *BallotBox) sign(message string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(bb.signingKey, []byte(message)))
+}
+
+// verifySignature checks a base64 encoded signature made by sign
+func verifySignature(publicKey ed25519.PublicKey, message string, signature string) bool {
+	raw, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(publicKey, []byte(message), raw)
+}
+
+func (bb *BallotBox) newReceipt(electionId string, voteHash string, writeCount int64) *Receipt {
+	receipt := &Receipt{
+		ElectionId: electionId,
+		VoteHash:   voteHash,
+		Timestamp:  bb.clock().Unix(),
+		WriteCount: writeCount,
+	}
+	receipt.Signature = bb.sign(receipt.message())
+	return receipt
+}
+
+func (bb *BallotBox) getSigningKey(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+	publicKey := bb.signingKey.Public().(ed25519.PublicKey)
+	return writeJson(w, http.StatusOK, map[string]string{
+		"algorithm":  "ed25519",
+		"public_key": base64.StdEncoding.EncodeToString(publicKey),
+	})
+}
@@ -0,0 +1,156 @@
+package ballotbox
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/agoravoting/agora-http-go/middleware"
+	s "github.com/agoravoting/agora-http-go/server"
+	"github.com/julienschmidt/httprouter"
+)
+
+// election lifecycle states, persisted in the vote store
+const (
+	StateCreated   = "created"
+	StateKeysReady = "keys-ready"
+	StateOpen      = "open"
+	StatePaused    = "paused"
+	StateClosed    = "closed"
+	StateTallied   = "tallied"
+)
+
+var ErrInvalidTransition = errors.New("Invalid election state transition")
+
+// allowed transitions, from state -> to states
+var stateTransitions = map[string][]string{
+	StateCreated:   {StateKeysReady},
+	StateKeysReady: {StateOpen},
+	StateOpen:      {StatePaused, StateClosed},
+	StatePaused:    {StateOpen, StateClosed},
+	StateClosed:    {StateTallied},
+}
+
+func validTransition(from string, to string) bool {
+	for _, state := range stateTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// implicitState returns the state of an election that has no row in the
+// elections table, inferred as the admin script used to do from the files
+// present in the election directory. Elections with a pk are open, as they
+// were before there were states, unless implicitOpen is disabled
+func implicitState(pk bool, implicitOpen bool) string {
+	switch {
+	case pk && implicitOpen:
+		return StateOpen
+	case pk:
+		return StateKeysReady
+	}
+	return StateCreated
+}
+
+// loadStates reads the persisted election states, elections without one
+// get their implicit state
+func (bb *BallotBox) loadStates(configs map[string]string) (states map[string]string, err error) {
+	stored, err := bb.store.ElectionStates()
+	if err != nil {
+		return
+	}
+	states = make(map[string]string)
+	for electionId := range configs {
+		_, pk := bb.pubkeyObjects[electionId]
+		states[electionId] = implicitState(pk, bb.implicitOpen)
+	}
+	for electionId, state := range stored {
+		states[electionId] = state
+	}
+	return
+}
+
+func (bb *BallotBox) electionState(electionId string) string {
+	bb.statesMutex.RLock()
+	defer bb.statesMutex.RUnlock()
+	return bb.states[electionId]
+}
+
+// setState persists a state transition, failing if the state was changed
+// concurrently
+func (bb *BallotBox) setState(electionId string, from string, to string) (err error) {
+	if !validTransition(from, to) {
+		return ErrInvalidTransition
+	}
+
+	if err = bb.store.SetElectionState(electionId, from, to); err != nil {
+		return
+	}
+
+	bb.statesMutex.Lock()
+	bb.states[electionId] = to
+	bb.statesMutex.Unlock()
+	s.Server.Logger.Printf("Election %s state changed from %s to %s", electionId, from, to)
+	return
+}
+
+// checkElectionStarted fails unless the election has been opened at some
+// point, so that it may hold votes
+func (bb *BallotBox) checkElectionStarted(electionId string) *middleware.HandledError {
+	switch bb.electionState(electionId) {
+	case StateOpen, StatePaused, StateClosed, StateTallied:
+		return nil
+	case "":
+		return &middleware.HandledError{Code: 404, Message: "Election not found", CodedMessage: "election-not-found"}
+	default:
+		return &middleware.HandledError{Code: 403, Message: "Election not open yet", CodedMessage: "election-not-open"}
+	}
+}
+
+func (bb *BallotBox) getElectionState(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+	var err error
+
+	electionId := p.ByName("election_id")
+	if electionId == "" {
+		return &middleware.HandledError{Err: err, Code: 400, Message: "No election_id", CodedMessage: "empty-election-id"}
+	}
+	state := bb.electionState(electionId)
+	if state == "" {
+		return &middleware.HandledError{Err: err, Code: 404, Message: "Not found", CodedMessage: "not-found"}
+	}
+
+	return writeJson(w, http.StatusOK, map[string]string{"election_id": electionId, "state": state})
+}
+
+func (bb *BallotBox) setElectionState(w http.ResponseWriter, r *http.Request, p httprouter.Params) *middleware.HandledError {
+	var err error
+
+	electionId := p.ByName("election_id")
+	to := p.ByName("state")
+	if electionId == "" {
+		return &middleware.HandledError{Err: err, Code: 400, Message: "No election_id", CodedMessage: "empty-election-id"}
+	}
+	from := bb.electionState(electionId)
+	if from == "" {
+		return &middleware.HandledError{Err: err, Code: 404, Message: "Not found", CodedMessage: "not-found"}
+	}
+	// setting the current state again is a no-op
+	if from == to {
+		return writeJson(w, http.StatusOK, map[string]string{"election_id": electionId, "state": to})
+	}
+	if to == StateKeysReady {
+		if _, ok := bb.pubkeyObjects[electionId]; !ok {
+			return &middleware.HandledError{Err: err, Code: 400, Message: "Pks not found for election", CodedMessage: "vote-pks-not-found"}
+		}
+	}
+
+	if err = bb.setState(electionId, from, to); err != nil {
+		if err == ErrInvalidTransition {
+			return &middleware.HandledError{Err: err, Code: 400, Message: "Invalid state transition from " + from, CodedMessage: "invalid-state-transition"}
+		}
+		return &middleware.HandledError{Err: err, Code: 409, Message: "Error changing the election state", CodedMessage: "error-state-change"}
+	}
+
+	return writeJson(w, http.StatusOK, map[string]string{"election_id": electionId, "state": to})
+}
@@ -0,0 +1,96 @@
+package ballotbox
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	s "github.com/agoravoting/agora-http-go/server"
+	"github.com/jmoiron/sqlx"
+)
+
+// VoteStore persists the ballots, the election census, the used token nonces
+// and the election states. The backend is chosen with the "voteStore" config
+// entry:
+//
+//   - "postgres", the default: the server database, with the schema in
+//     db/migrations
+//   - "sqlite": the sqlite3 database at "voteStorePath", created if needed
+//   - "memory": nothing is persisted, for tests and throwaway elections
+type VoteStore interface {
+	// CastVote stores v as the vote of v.VoterId in v.ElectionId, replacing
+	// the previous one of the voter, unless the vote hash is taken or limits
+	// refuse it. If stored, the cast is added to the voter history and v.Id
+	// and v.WriteCount are set. With limits.KeepFirst re-casts are only added
+	// to the history
+	CastVote(v *Vote, ip string, limits CastLimits) (CastResult, error)
+	// FindVote returns the current vote of the voter if it has the given
+	// hash, nil otherwise
+	FindVote(electionId string, voterId string, voteHash string) (*Vote, error)
+	// IterateVotes calls fn with the current votes of an election with id
+	// greater than after, ordered by id, at most limit if it is not 0. The
+	// vote text, ip, dates and write count are only loaded if withVote is set
+	IterateVotes(electionId string, after int64, limit int, withVote bool, fn func(v *Vote) error) error
+	// CountVotes returns the number of current votes of an election
+	CountVotes(electionId string) (int64, error)
+	// VoteHistory returns every accepted cast of a voter, oldest first
+	VoteHistory(electionId string, voterId string) ([]*CastRecord, error)
+
+	// AddToCensus adds voters to the census of an election, returning how
+	// many were not in it already. The election has a census from then on,
+	// even if voterIds is empty
+	AddToCensus(electionId string, voterIds []string) (added int64, err error)
+	// RemoveFromCensus returns whether the voter was in the census
+	RemoveFromCensus(electionId string, voterId string) (bool, error)
+	InCensus(electionId string, voterId string) (bool, error)
+	CensusSize(electionId string) (int64, error)
+	// HasCensus returns whether voters were ever added to the census of an
+	// election, which is kept when all of them are removed
+	HasCensus(electionId string) (bool, error)
+
+	// UseNonce records the nonce of a one-time voter token until expires,
+	// never forgotten if it is zero, returning false if it was already used
+	// in the election. Expired nonces are dropped
+	UseNonce(electionId string, nonce string, expires time.Time) (bool, error)
+	// ReleaseNonce forgets a used nonce, so that the token of a failed
+	// request can be retried
+	ReleaseNonce(electionId string, nonce string) error
+
+	// ElectionStates returns the stored election states by election id
+	ElectionStates() (map[string]string, error)
+	// SetElectionState stores the state of an election, failing with
+	// ErrStateConflict if it is not from
+	SetElectionState(electionId string, from string, to string) error
+}
+
+var ErrStateConflict = errors.New("Election state changed concurrently")
+
+// openVoteStore returns the store configured in cfg
+func openVoteStore(cfg map[string]*json.RawMessage) (VoteStore, error) {
+	var name, path string
+	if value, ok := cfg["voteStore"]; ok {
+		json.Unmarshal(*value, &name)
+	}
+	if value, ok := cfg["voteStorePath"]; ok {
+		json.Unmarshal(*value, &path)
+	}
+	return OpenVoteStore(name, path, s.Server.Db)
+}
+
+// OpenVoteStore returns the store named like the "voteStore" config entry,
+// path is the "voteStorePath" entry and db the database of the postgres
+// store. It is used by the admin tools
+func OpenVoteStore(name string, path string, db *sqlx.DB) (VoteStore, error) {
+	switch name {
+	case "", "postgres":
+		return newPostgresStore(db)
+	case "sqlite":
+		if path == "" {
+			return nil, errors.New("voteStorePath is required for the sqlite voteStore")
+		}
+		return openSqliteStore(path)
+	case "memory":
+		return newMemoryStore(), nil
+	}
+	return nil, errors.New("Unknown voteStore " + name)
+}
@@ -0,0 +1,252 @@
+package ballotbox
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps the votes and election states in memory, nothing
+// survives a restart
+type memoryStore struct {
+	mutex  sync.RWMutex
+	lastId int64
+	// current votes by election id and voter id
+	votes map[string]map[string]*Vote
+	// current votes by vote hash, hashes are unique across elections
+	hashes map[string]*Vote
+	// casts by election id and voter id
+	history map[string]map[string][]*CastRecord
+	// voter ids by election id
+	census map[string]map[string]bool
+	// expiration of the used nonces by election id and nonce
+	nonces map[string]map[string]time.Time
+	// nonces are pruned at most once per nonceTTLCheck
+	noncesPruned time.Time
+	states       map[string]string
+}
+
+const nonceTTLCheck = time.Minute
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		votes:   make(map[string]map[string]*Vote),
+		hashes:  make(map[string]*Vote),
+		history: make(map[string]map[string][]*CastRecord),
+		census:  make(map[string]map[string]bool),
+		nonces:  make(map[string]map[string]time.Time),
+		states:  make(map[string]string),
+	}
+}
+
+func (st *memoryStore) CastVote(v *Vote, ip string, limits CastLimits) (CastResult, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if owner, ok := st.hashes[v.VoteHash]; ok && (owner.ElectionId != v.ElectionId || owner.VoterId != v.VoterId) {
+		return CastHashTaken, nil
+	}
+	election, ok := st.votes[v.ElectionId]
+	if !ok {
+		election = make(map[string]*Vote)
+		st.votes[v.ElectionId] = election
+	}
+
+	now := time.Now()
+	result := CastStored
+	stored := &Vote{Vote: v.Vote, VoteHash: v.VoteHash, ElectionId: v.ElectionId, VoterId: v.VoterId, Ip: ip, Modified: now}
+	if current, ok := election[v.VoterId]; ok {
+		if result = limits.allows(current.WriteCount, current.Modified, now); result != CastStored {
+			return result, nil
+		}
+		if limits.KeepFirst {
+			current.WriteCount++
+			current.Modified = now
+			st.record(v, ip, now, current.WriteCount, false)
+			return CastRecorded, nil
+		}
+		delete(st.hashes, current.VoteHash)
+		stored.Id = current.Id
+		stored.Created = current.Created
+		stored.WriteCount = current.WriteCount + 1
+	} else {
+		st.lastId++
+		stored.Id = st.lastId
+		stored.Created = now
+		stored.WriteCount = 1
+	}
+	election[v.VoterId] = stored
+	st.hashes[v.VoteHash] = stored
+	st.record(v, ip, now, stored.WriteCount, true)
+
+	v.Id = stored.Id
+	v.WriteCount = stored.WriteCount
+	return CastStored, nil
+}
+
+// record appends a cast to the voter history, the mutex must be held
+func (st *memoryStore) record(v *Vote, ip string, now time.Time, writeCount int64, counted bool) {
+	if _, ok := st.history[v.ElectionId]; !ok {
+		st.history[v.ElectionId] = make(map[string][]*CastRecord)
+	}
+	st.history[v.ElectionId][v.VoterId] = append(st.history[v.ElectionId][v.VoterId],
+		&CastRecord{VoteHash: v.VoteHash, Vote: v.Vote, Ip: ip, Created: now, WriteCount: writeCount, Counted: counted})
+}
+
+func (st *memoryStore) FindVote(electionId string, voterId string, voteHash string) (*Vote, error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	current, ok := st.votes[electionId][voterId]
+	if !ok || current.VoteHash != voteHash {
+		return nil, nil
+	}
+	v := *current
+	return &v, nil
+}
+
+func (st *memoryStore) IterateVotes(electionId string, after int64, limit int, withVote bool, fn func(v *Vote) error) error {
+	// copy the page so that fn runs unlocked
+	st.mutex.RLock()
+	var votes []*Vote
+	for _, current := range st.votes[electionId] {
+		if current.Id > after {
+			v := *current
+			if !withVote {
+				v.Vote = ""
+			}
+			votes = append(votes, &v)
+		}
+	}
+	st.mutex.RUnlock()
+
+	sort.Slice(votes, func(i, j int) bool { return votes[i].Id < votes[j].Id })
+	if limit > 0 && len(votes) > limit {
+		votes = votes[:limit]
+	}
+	for _, v := range votes {
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *memoryStore) CountVotes(electionId string) (int64, error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return int64(len(st.votes[electionId])), nil
+}
+
+func (st *memoryStore) VoteHistory(electionId string, voterId string) ([]*CastRecord, error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	var casts []*CastRecord
+	for _, c := range st.history[electionId][voterId] {
+		copied := *c
+		casts = append(casts, &copied)
+	}
+	return casts, nil
+}
+
+func (st *memoryStore) AddToCensus(electionId string, voterIds []string) (added int64, err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	census, ok := st.census[electionId]
+	if !ok {
+		census = make(map[string]bool)
+		st.census[electionId] = census
+	}
+	for _, voterId := range voterIds {
+		if !census[voterId] {
+			census[voterId] = true
+			added++
+		}
+	}
+	return
+}
+
+func (st *memoryStore) RemoveFromCensus(electionId string, voterId string) (bool, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if !st.census[electionId][voterId] {
+		return false, nil
+	}
+	delete(st.census[electionId], voterId)
+	return true, nil
+}
+
+func (st *memoryStore) HasCensus(electionId string) (bool, error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	_, ok := st.census[electionId]
+	return ok, nil
+}
+
+func (st *memoryStore) InCensus(electionId string, voterId string) (bool, error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.census[electionId][voterId], nil
+}
+
+func (st *memoryStore) CensusSize(electionId string) (int64, error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return int64(len(st.census[electionId])), nil
+}
+
+func (st *memoryStore) UseNonce(electionId string, nonce string, expires time.Time) (bool, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(st.noncesPruned) > nonceTTLCheck {
+		for _, nonces := range st.nonces {
+			for n, e := range nonces {
+				if !e.IsZero() && e.Before(now) {
+					delete(nonces, n)
+				}
+			}
+		}
+		st.noncesPruned = now
+	}
+
+	nonces, ok := st.nonces[electionId]
+	if !ok {
+		nonces = make(map[string]time.Time)
+		st.nonces[electionId] = nonces
+	}
+	if e, used := nonces[nonce]; used && (e.IsZero() || !e.Before(now)) {
+		return false, nil
+	}
+	nonces[nonce] = expires
+	return true, nil
+}
+
+func (st *memoryStore) ReleaseNonce(electionId string, nonce string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	delete(st.nonces[electionId], nonce)
+	return nil
+}
+
+func (st *memoryStore) ElectionStates() (map[string]string, error) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	states := make(map[string]string, len(st.states))
+	for electionId, state := range st.states {
+		states[electionId] = state
+	}
+	return states, nil
+}
+
+func (st *memoryStore) SetElectionState(electionId string, from string, to string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	// a missing state is the implicit one, which the caller checked
+	if state, ok := st.states[electionId]; ok && state != from {
+		return ErrStateConflict
+	}
+	st.states[electionId] = to
+	return nil
+}
@@ -0,0 +1,385 @@
+package ballotbox
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlStore implements VoteStore with plain sql, queries are written with ?
+// placeholders and rebound for the driver
+type sqlStore struct {
+	db *sqlx.DB
+}
+
+// postgresStore uses the cast_vote and use_nonce functions of db/migrations
+type postgresStore struct {
+	sqlStore
+	castStmt  *sqlx.Stmt
+	nonceStmt *sqlx.Stmt
+}
+
+// schema of the sqlite databases, the same tables as db/migrations
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS votes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	vote TEXT NOT NULL,
+	vote_hash VARCHAR(1024) NOT NULL UNIQUE,
+	election_id VARCHAR(1024) NOT NULL,
+	voter_id VARCHAR(1024) NOT NULL,
+	ip VARCHAR(64) NOT NULL,
+	created TIMESTAMP DEFAULT current_timestamp,
+	modified TIMESTAMP DEFAULT current_timestamp,
+	write_count INT DEFAULT 1
+);
+CREATE UNIQUE INDEX IF NOT EXISTS voter_id_election_id ON votes(voter_id, election_id);
+CREATE TABLE IF NOT EXISTS vote_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	vote_id INT NOT NULL REFERENCES votes(id),
+	vote TEXT NOT NULL,
+	vote_hash VARCHAR(1024) NOT NULL,
+	election_id VARCHAR(1024) NOT NULL,
+	voter_id VARCHAR(1024) NOT NULL,
+	ip VARCHAR(64) NOT NULL,
+	created TIMESTAMP DEFAULT current_timestamp,
+	write_count INT NOT NULL,
+	counted BOOLEAN NOT NULL DEFAULT TRUE
+);
+CREATE INDEX IF NOT EXISTS vote_history_election_id_voter_id ON vote_history(election_id, voter_id);
+CREATE TABLE IF NOT EXISTS census (
+	election_id VARCHAR(1024) NOT NULL,
+	voter_id VARCHAR(1024) NOT NULL,
+	created TIMESTAMP DEFAULT current_timestamp,
+	PRIMARY KEY (election_id, voter_id)
+);
+CREATE TABLE IF NOT EXISTS census_elections (
+	election_id VARCHAR(1024) PRIMARY KEY,
+	created TIMESTAMP DEFAULT current_timestamp
+);
+CREATE TABLE IF NOT EXISTS token_nonces (
+	election_id VARCHAR(1024) NOT NULL,
+	nonce VARCHAR(128) NOT NULL,
+	expires TIMESTAMP,
+	PRIMARY KEY (election_id, nonce)
+);
+CREATE INDEX IF NOT EXISTS token_nonces_expires ON token_nonces(expires);
+CREATE TABLE IF NOT EXISTS elections (
+	id VARCHAR(1024) PRIMARY KEY,
+	state VARCHAR(32) NOT NULL,
+	created TIMESTAMP DEFAULT current_timestamp,
+	modified TIMESTAMP DEFAULT current_timestamp
+);
+`
+
+func newPostgresStore(db *sqlx.DB) (store *postgresStore, err error) {
+	store = &postgresStore{sqlStore: sqlStore{db}}
+	if store.castStmt, err = db.Preparex("SELECT result, cast_id, cast_write_count FROM cast_vote($1, $2, $3, $4, $5, $6, $7, $8)"); err != nil {
+		return
+	}
+	if store.nonceStmt, err = db.Preparex("SELECT use_nonce($1, $2, $3)"); err != nil {
+		return
+	}
+	return
+}
+
+// openSqliteStore opens the sqlite3 database at path, creating the tables if
+// needed
+func openSqliteStore(path string) (store *sqlStore, err error) {
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		return
+	}
+	// sqlite allows a single writer
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return
+	}
+	return &sqlStore{db}, nil
+}
+
+// CastVote calls cast_vote, which runs in the transaction of the statement
+// and returns the id and write count of the stored vote
+func (st *postgresStore) CastVote(v *Vote, ip string, limits CastLimits) (CastResult, error) {
+	var cast struct {
+		Result     CastResult    `db:"result"`
+		Id         sql.NullInt64 `db:"cast_id"`
+		WriteCount sql.NullInt64 `db:"cast_write_count"`
+	}
+	cooldown := int(limits.Cooldown / time.Second)
+	if err := st.castStmt.Get(&cast, v.Vote, v.VoteHash, v.ElectionId, v.VoterId, ip, limits.MaxWrites, cooldown, limits.KeepFirst); err != nil {
+		return "", err
+	}
+	if cast.Result == CastStored {
+		v.Id, v.WriteCount = cast.Id.Int64, cast.WriteCount.Int64
+	}
+	return cast.Result, nil
+}
+
+// CastVote does what cast_vote does in a transaction, for databases without
+// stored procedures
+func (st *sqlStore) CastVote(v *Vote, ip string, limits CastLimits) (result CastResult, err error) {
+	tx, err := st.db.Beginx()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil || (result != CastStored && result != CastRecorded) {
+			tx.Rollback()
+		}
+	}()
+
+	var owner Vote
+	err = tx.Get(&owner, st.db.Rebind("SELECT election_id, voter_id FROM votes WHERE vote_hash = ?"), v.VoteHash)
+	if err == nil && (owner.ElectionId != v.ElectionId || owner.VoterId != v.VoterId) {
+		return CastHashTaken, nil
+	} else if err != nil && err != sql.ErrNoRows {
+		return
+	}
+
+	var current Vote
+	counted := true
+	err = tx.Get(&current, st.db.Rebind("SELECT id, write_count, modified FROM votes WHERE election_id = ? and voter_id = ?"), v.ElectionId, v.VoterId)
+	switch {
+	case err == sql.ErrNoRows:
+		var inserted sql.Result
+		if inserted, err = tx.Exec(st.db.Rebind("INSERT INTO votes(vote, vote_hash, election_id, voter_id, ip) VALUES (?, ?, ?, ?, ?)"), v.Vote, v.VoteHash, v.ElectionId, v.VoterId, ip); err != nil {
+			return
+		}
+		if v.Id, err = inserted.LastInsertId(); err != nil {
+			return
+		}
+		v.WriteCount = 1
+	case err != nil:
+		return
+	default:
+		if result = limits.allows(current.WriteCount, current.Modified, time.Now()); result != CastStored {
+			return result, nil
+		}
+		query := "UPDATE votes SET vote = ?, vote_hash = ?, ip = ?, modified = current_timestamp, write_count = write_count + 1 WHERE id = ?"
+		args := []interface{}{v.Vote, v.VoteHash, ip, current.Id}
+		if limits.KeepFirst {
+			query = "UPDATE votes SET modified = current_timestamp, write_count = write_count + 1 WHERE id = ?"
+			args = []interface{}{current.Id}
+			counted = false
+		}
+		if _, err = tx.Exec(st.db.Rebind(query), args...); err != nil {
+			return
+		}
+		v.Id = current.Id
+		v.WriteCount = current.WriteCount + 1
+	}
+	if _, err = tx.Exec(st.db.Rebind("INSERT INTO vote_history(vote_id, vote, vote_hash, election_id, voter_id, ip, write_count, counted) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"), v.Id, v.Vote, v.VoteHash, v.ElectionId, v.VoterId, ip, v.WriteCount, counted); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	if !counted {
+		// the counted ballot is still the first one
+		v.Id, v.WriteCount = 0, 0
+		return CastRecorded, nil
+	}
+	return CastStored, nil
+}
+
+func (st *sqlStore) FindVote(electionId string, voterId string, voteHash string) (*Vote, error) {
+	var votes []Vote
+	if err := st.db.Select(&votes, st.db.Rebind("SELECT id, vote, vote_hash, election_id, voter_id FROM votes WHERE election_id = ? and voter_id = ? and vote_hash = ?"), electionId, voterId, voteHash); err != nil {
+		return nil, err
+	}
+	if len(votes) == 0 {
+		return nil, nil
+	}
+	return &votes[0], nil
+}
+
+func (st *sqlStore) IterateVotes(electionId string, after int64, limit int, withVote bool, fn func(v *Vote) error) error {
+	query := "SELECT id, vote_hash, election_id, voter_id FROM votes WHERE election_id = ? AND id > ? ORDER BY id"
+	if withVote {
+		query = "SELECT id, vote, vote_hash, election_id, voter_id, ip, created, modified, write_count FROM votes WHERE election_id = ? AND id > ? ORDER BY id"
+	}
+	args := []interface{}{electionId, after}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := st.db.Queryx(st.db.Rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		v := &Vote{}
+		if err = rows.StructScan(v); err != nil {
+			return err
+		}
+		if err = fn(v); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (st *sqlStore) CountVotes(electionId string) (count int64, err error) {
+	err = st.db.Get(&count, st.db.Rebind("SELECT count(*) FROM votes WHERE election_id = ?"), electionId)
+	return
+}
+
+func (st *sqlStore) VoteHistory(electionId string, voterId string) (casts []*CastRecord, err error) {
+	err = st.db.Select(&casts, st.db.Rebind("SELECT vote, vote_hash, ip, created, write_count, counted FROM vote_history WHERE election_id = ? AND voter_id = ? ORDER BY id"), electionId, voterId)
+	return
+}
+
+// AddToCensus marks the election and inserts the voters in a transaction,
+// without ON CONFLICT so that older Postgres versions work
+func (st *sqlStore) AddToCensus(electionId string, voterIds []string) (added int64, err error) {
+	tx, err := st.db.Beginx()
+	if err != nil {
+		return
+	}
+	if _, err = tx.Exec(st.db.Rebind("INSERT INTO census_elections(election_id) SELECT ? WHERE NOT EXISTS (SELECT 1 FROM census_elections WHERE election_id = ?)"), electionId, electionId); err != nil {
+		tx.Rollback()
+		return
+	}
+	stmt, err := tx.Preparex(st.db.Rebind("INSERT INTO census(election_id, voter_id) SELECT ?, ? WHERE NOT EXISTS (SELECT 1 FROM census WHERE election_id = ? AND voter_id = ?)"))
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	for _, voterId := range voterIds {
+		var result sql.Result
+		if result, err = stmt.Exec(electionId, voterId, electionId, voterId); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		var inserted int64
+		if inserted, err = result.RowsAffected(); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		added += inserted
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return
+}
+
+func (st *sqlStore) RemoveFromCensus(electionId string, voterId string) (bool, error) {
+	result, err := st.db.Exec(st.db.Rebind("DELETE FROM census WHERE election_id = ? AND voter_id = ?"), electionId, voterId)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+func (st *sqlStore) HasCensus(electionId string) (bool, error) {
+	var count int64
+	err := st.db.Get(&count, st.db.Rebind("SELECT count(*) FROM census_elections WHERE election_id = ?"), electionId)
+	return count > 0, err
+}
+
+func (st *sqlStore) InCensus(electionId string, voterId string) (bool, error) {
+	var count int64
+	err := st.db.Get(&count, st.db.Rebind("SELECT count(*) FROM census WHERE election_id = ? AND voter_id = ?"), electionId, voterId)
+	return count > 0, err
+}
+
+func (st *sqlStore) CensusSize(electionId string) (count int64, err error) {
+	err = st.db.Get(&count, st.db.Rebind("SELECT count(*) FROM census WHERE election_id = ?"), electionId)
+	return
+}
+
+// nonceExpires returns the expires column value of a nonce, NULL if it never
+// expires
+func nonceExpires(expires time.Time) interface{} {
+	if expires.IsZero() {
+		return nil
+	}
+	return expires.UTC()
+}
+
+func (st *postgresStore) UseNonce(electionId string, nonce string, expires time.Time) (fresh bool, err error) {
+	err = st.nonceStmt.Get(&fresh, electionId, nonce, nonceExpires(expires))
+	return
+}
+
+// UseNonce drops the expired nonces and inserts the new one in a
+// transaction, for databases without stored procedures
+func (st *sqlStore) UseNonce(electionId string, nonce string, expires time.Time) (fresh bool, err error) {
+	tx, err := st.db.Beginx()
+	if err != nil {
+		return
+	}
+	if _, err = tx.Exec(st.db.Rebind("DELETE FROM token_nonces WHERE expires < ?"), time.Now().UTC()); err != nil {
+		tx.Rollback()
+		return
+	}
+	result, err := tx.Exec(st.db.Rebind("INSERT INTO token_nonces(election_id, nonce, expires) SELECT ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM token_nonces WHERE election_id = ? AND nonce = ?)"),
+		electionId, nonce, nonceExpires(expires), electionId, nonce)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return inserted == 1, nil
+}
+
+func (st *sqlStore) ReleaseNonce(electionId string, nonce string) error {
+	_, err := st.db.Exec(st.db.Rebind("DELETE FROM token_nonces WHERE election_id = ? AND nonce = ?"), electionId, nonce)
+	return err
+}
+
+func (st *sqlStore) ElectionStates() (states map[string]string, err error) {
+	var rows []struct {
+		Id    string `db:"id"`
+		State string `db:"state"`
+	}
+	if err = st.db.Select(&rows, "SELECT id, state FROM elections"); err != nil {
+		return
+	}
+	states = make(map[string]string)
+	for _, row := range rows {
+		states[row.Id] = row.State
+	}
+	return
+}
+
+func (st *sqlStore) SetElectionState(electionId string, from string, to string) (err error) {
+	tx, err := st.db.Beginx()
+	if err != nil {
+		return
+	}
+	var result sql.Result
+	result, err = tx.Exec(st.db.Rebind("UPDATE elections SET state = ?, modified = current_timestamp WHERE id = ? AND state = ?"), to, electionId, from)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	var updated int64
+	if updated, err = result.RowsAffected(); err != nil {
+		tx.Rollback()
+		return
+	}
+	if updated == 0 {
+		// no row yet, the implicit state is being left. The primary key
+		// makes concurrent inserts fail
+		if _, err = tx.Exec(st.db.Rebind("INSERT INTO elections(id, state) VALUES (?, ?)"), electionId, to); err != nil {
+			tx.Rollback()
+			return ErrStateConflict
+		}
+	}
+	return tx.Commit()
+}
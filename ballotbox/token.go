@@ -0,0 +1,162 @@
+package ballotbox
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Signed voter tokens are an alternative to the HMAC ones, the ballotbox only
+// holds the public keys of the authentication service, so it can't forge
+// them. An election accepts them, and only them, if its directory holds an
+// authkeys_<election-id> file with one or more PEM "PUBLIC KEY" blocks,
+// Ed25519 or RSA. Several keys allow rotation like the secrets file.
+//
+// Tokens are JWTs sent as "Authorization: Bearer <token>", with the EdDSA or
+// RS256 algorithm, the permission as subject, an expiration time and, for
+// one-time tokens, a nonce as jti:
+//
+//	{"alg": "EdDSA", "typ": "JWT"} . {"sub": "voter-<eid>-<vid>", "exp": <unix>, "jti": <nonce>}
+
+var ErrUnsupportedKey = errors.New("Unsupported key type")
+
+// minRSABits is the smallest RSA modulus accepted in an authkeys file
+const minRSABits = 2048
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+type tokenClaims struct {
+	Sub string `json:"sub"`
+	Iat int64  `json:"iat,omitempty"`
+	Exp int64  `json:"exp"`
+	Jti string `json:"jti,omitempty"`
+}
+
+// tokenAlg returns the JWT algorithm used with key, a public or private key
+func tokenAlg(key interface{}) string {
+	switch key.(type) {
+	case ed25519.PublicKey, ed25519.PrivateKey:
+		return "EdDSA"
+	case *rsa.PublicKey, *rsa.PrivateKey:
+		return "RS256"
+	}
+	return ""
+}
+
+// parseAuthKeys returns the public keys of an authkeys file
+func parseAuthKeys(text string) (keys []crypto.PublicKey, err error) {
+	rest := []byte(text)
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			return nil, errors.New("Unexpected PEM block " + block.Type)
+		}
+		var key interface{}
+		if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, err
+		}
+		if tokenAlg(key) == "" {
+			return nil, ErrUnsupportedKey
+		}
+		if rsaKey, ok := key.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA key of %d bits, at least %d required", rsaKey.N.BitLen(), minRSABits)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("No public key found")
+	}
+	return
+}
+
+// SignVoterToken returns a token granting perm until expires, signed with an
+// Ed25519 or RSA private key. nonce is empty unless it is a one-time token
+func SignVoterToken(key crypto.Signer, perm string, expires time.Time, nonce string) (string, error) {
+	alg := tokenAlg(key)
+	if alg == "" {
+		return "", ErrUnsupportedKey
+	}
+	header, _ := json.Marshal(tokenHeader{Alg: alg, Typ: "JWT"})
+	claims, _ := json.Marshal(tokenClaims{Sub: perm, Iat: time.Now().Unix(), Exp: expires.Unix(), Jti: nonce})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	var (
+		signature []byte
+		err       error
+	)
+	if alg == "EdDSA" {
+		signature, err = key.Sign(rand.Reader, []byte(signed), crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256([]byte(signed))
+		signature, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// checkVoterToken returns the token if it is signed by one of keys, grants
+// perm and has not expired, nil otherwise
+func checkVoterToken(token string, perm string, keys []crypto.PublicKey, now time.Time) *voterToken {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	var (
+		header tokenHeader
+		claims tokenClaims
+	)
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJson, &header) != nil {
+		return nil
+	}
+	claimsJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(claimsJson, &claims) != nil {
+		return nil
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil
+	}
+	if claims.Sub != perm || claims.Exp == 0 || now.Unix() >= claims.Exp {
+		return nil
+	}
+	valid := &voterToken{Nonce: claims.Jti, Expires: time.Unix(claims.Exp, 0)}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+	for _, key := range keys {
+		// the algorithm must be the one of the key, never chosen by the token
+		if tokenAlg(key) != header.Alg {
+			continue
+		}
+		switch k := key.(type) {
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, signed, signature) {
+				return valid
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil {
+				return valid
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package ballotbox
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Proofs of knowledge of the ballot randomness are checked with the equation
+// g^response = commitment * alpha^challenge mod p, two modular
+// exponentiations per choice. A popkVerifier decides how the checks of a
+// ballot are run:
+//
+//   - sequential: one after the other on the calling goroutine, the default
+//   - parallel: each choice on its own goroutine
+//   - batch: checks of the ballots arriving within a short window are
+//     verified together with a randomized batch equation, falling back to
+//     individual checks when the batch fails
+
+var ErrPopkVerification = errors.New("Failed verifying popk")
+
+// bits of the random exponents used in batch verification, a batch with an
+// invalid proof passes with probability 2^-batchSecurityBits
+const batchSecurityBits = 128
+
+const (
+	defaultBatchWindow = 5 * time.Millisecond
+	defaultBatchSize   = 64
+)
+
+// proofCheck is the verification equation of one proof
+type proofCheck interface {
+	verify() bool
+}
+
+// popkCheck is the verification equation of one choice proof
+type popkCheck struct {
+	pk         map[string]*big.Int
+	alpha      *big.Int
+	commitment *big.Int
+	challenge  *big.Int
+	response   *big.Int
+}
+
+func (c *popkCheck) verify() bool {
+	p := c.pk["p"]
+	first := new(big.Int).Exp(c.pk["g"], c.response, p)
+
+	second := new(big.Int).Exp(c.alpha, c.challenge, p)
+	second.Mul(second, c.commitment)
+	second.Mod(second, p)
+
+	return first.Cmp(second) == 0
+}
+
+type popkVerifier interface {
+	verify(checks []proofCheck) error
+}
+
+type sequentialVerifier struct{}
+
+func (sequentialVerifier) verify(checks []proofCheck) error {
+	for _, check := range checks {
+		if !check.verify() {
+			return ErrPopkVerification
+		}
+	}
+	return nil
+}
+
+type parallelVerifier struct{}
+
+func (parallelVerifier) verify(checks []proofCheck) error {
+	if len(checks) == 1 {
+		return sequentialVerifier{}.verify(checks)
+	}
+	results := make([]bool, len(checks))
+	var wg sync.WaitGroup
+	for index, check := range checks {
+		wg.Add(1)
+		go func(index int, check proofCheck) {
+			defer wg.Done()
+			results[index] = check.verify()
+		}(index, check)
+	}
+	wg.Wait()
+	for _, ok := range results {
+		if !ok {
+			return ErrPopkVerification
+		}
+	}
+	return nil
+}
+
+// newPopkVerifier returns the verifier configured by name, an empty name is
+// the sequential verifier
+func newPopkVerifier(name string, window time.Duration, size int) (popkVerifier, error) {
+	switch name {
+	case "", "sequential":
+		return sequentialVerifier{}, nil
+	case "parallel":
+		return parallelVerifier{}, nil
+	case "batch":
+		return newBatchVerifier(window, size), nil
+	}
+	return nil, errors.New("Unknown proofVerifier " + name)
+}
+
+type batchRequest struct {
+	checks []proofCheck
+	result chan error
+}
+
+// batchVerifier collects the checks of the ballots submitted within window of
+// the first one, or until size checks are queued, and verifies them together
+type batchVerifier struct {
+	window   time.Duration
+	size     int
+	requests chan *batchRequest
+}
+
+func newBatchVerifier(window time.Duration, size int) *batchVerifier {
+	if window <= 0 {
+		window = defaultBatchWindow
+	}
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	b := &batchVerifier{window: window, size: size, requests: make(chan *batchRequest, size)}
+	go b.run()
+	return b
+}
+
+func (b *batchVerifier) verify(checks []proofCheck) error {
+	// only ElGamal proofs can be batched
+	for _, check := range checks {
+		if _, ok := check.(*popkCheck); !ok {
+			return parallelVerifier{}.verify(checks)
+		}
+	}
+	request := &batchRequest{checks: checks, result: make(chan error, 1)}
+	b.requests <- request
+	return <-request.result
+}
+
+// stop ends the collecting goroutine, verify must not be called afterwards
+func (b *batchVerifier) stop() {
+	close(b.requests)
+}
+
+func (b *batchVerifier) run() {
+	for first := range b.requests {
+		batch := []*batchRequest{first}
+		queued := len(first.checks)
+		timer := time.NewTimer(b.window)
+	collect:
+		for queued < b.size {
+			select {
+			case request, ok := <-b.requests:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, request)
+				queued += len(request.checks)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		go processBatch(batch)
+	}
+}
+
+// processBatch answers every request of the batch, if the batch equation
+// fails each request is verified on its own so that an invalid ballot
+// doesn't reject the others
+func processBatch(batch []*batchRequest) {
+	var checks []proofCheck
+	for _, request := range batch {
+		checks = append(checks, request.checks...)
+	}
+	if len(checks) > 1 && batchVerify(checks) {
+		for _, request := range batch {
+			request.result <- nil
+		}
+		return
+	}
+	for _, request := range batch {
+		request.result <- parallelVerifier{}.verify(request.checks)
+	}
+}
+
+// batchVerify checks all the equations at once. For each group (p, q, g) and
+// t_i = commitment_i * alpha_i^challenge_i, with random r_i:
+//
+//	g^(sum r_i * response_i) = prod t_i^r_i
+//
+// Each check then costs the short alpha^challenge and t^r exponentiations
+// instead of the full size g^response, and the batch one full size
+// exponentiation per group. This only proves t_i = g^response_i if every t_i
+// is in the order q subgroup, otherwise that check would fail anyway and the
+// batch is refused. The membership is checked with the jacobi symbol, a
+// full size exponentiation would cancel the gain
+func batchVerify(proofChecks []proofCheck) bool {
+	groups := make(map[string][]*popkCheck)
+	for _, proofCheck := range proofChecks {
+		check, ok := proofCheck.(*popkCheck)
+		if !ok {
+			return false
+		}
+		key := check.pk["p"].Text(16) + "/" + check.pk["g"].Text(16)
+		groups[key] = append(groups[key], check)
+	}
+
+	bound := new(big.Int).Lsh(bigOne, batchSecurityBits)
+	for _, group := range groups {
+		pk := group[0].pk
+		p, q, g := pk["p"], pk["q"], pk["g"]
+		if q == nil {
+			return false
+		}
+
+		exponent := new(big.Int)
+		product := big.NewInt(1)
+		t := new(big.Int)
+		tmp := new(big.Int)
+		for _, check := range group {
+			t.Exp(check.alpha, check.challenge, p)
+			t.Mul(t, check.commitment)
+			t.Mod(t, p)
+			if !quadraticResidue(t, p) {
+				return false
+			}
+			r, err := rand.Int(rand.Reader, bound)
+			if err != nil {
+				return false
+			}
+			exponent.Add(exponent, tmp.Mul(r, check.response))
+			product.Mul(product, tmp.Exp(t, r, p))
+			product.Mod(product, p)
+		}
+		exponent.Mod(exponent, q)
+		if new(big.Int).Exp(g, exponent, p).Cmp(product) != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agoravoting/agora-api/ballotbox"
+	"github.com/agoravoting/agora-http-go/middleware"
+)
+
+// the dates of list_votes, as postgres writes timestamps
+const voteTimeFormat = "2006-01-02 15:04:05.999999"
+
+// columns of the votes table, the only keys allowed in list_votes filters
+var voteColumns = map[string]func(v *ballotbox.Vote) string{
+	"id":          func(v *ballotbox.Vote) string { return strconv.FormatInt(v.Id, 10) },
+	"vote":        func(v *ballotbox.Vote) string { return v.Vote },
+	"vote_hash":   func(v *ballotbox.Vote) string { return v.VoteHash },
+	"election_id": func(v *ballotbox.Vote) string { return v.ElectionId },
+	"voter_id":    func(v *ballotbox.Vote) string { return v.VoterId },
+	"ip":          func(v *ballotbox.Vote) string { return v.Ip },
+	"created":     func(v *ballotbox.Vote) string { return v.Created.Format(voteTimeFormat) },
+	"modified":    func(v *ballotbox.Vote) string { return v.Modified.Format(voteTimeFormat) },
+	"write_count": func(v *ballotbox.Vote) string { return strconv.FormatInt(v.WriteCount, 10) },
+}
+
+func discardLog(format string, v ...interface{}) {}
+
+func listElections(a *admin, args []string) (err error) {
+	elections, err := ballotbox.ListElections(a.cfg.ElectionDir, a.cfg.implicitOpen(), discardLog)
+	if err != nil {
+		return
+	}
+
+	// the stored states override the implicit ones
+	if store, err := a.store(); err != nil {
+		fmt.Fprintf(os.Stderr, "could not read election states: %v\n", err)
+	} else {
+		states, err := store.ElectionStates()
+		if err != nil {
+			return err
+		}
+		for _, election := range elections {
+			if state, ok := states[election.Id]; ok {
+				election.State = state
+			}
+		}
+	}
+
+	rows := [][]string{}
+	for _, e := range elections {
+		rows = append(rows, []string{e.Id, e.Director, e.Authorities, strconv.FormatBool(e.Pk),
+			strconv.FormatBool(e.Ctexts), strconv.FormatBool(e.Tally), e.State, e.Error})
+	}
+	return a.output([]string{"election id", "director", "authorities", "pk", "ctexts", "tally", "state", "error"}, rows, elections)
+}
+
+func countVotes(a *admin, args []string) (err error) {
+	if len(args) == 0 {
+		return errors.New("no election ids")
+	}
+	store, err := a.store()
+	if err != nil {
+		return
+	}
+
+	var count int64
+	if err = distinctVotes(store, args, false, func(*ballotbox.Vote) error {
+		count++
+		return nil
+	}); err != nil {
+		return
+	}
+
+	// turnout against the census, when the elections have one. A voter in the
+	// census of several elections counts once in each
+	var census int64
+	for _, electionId := range args {
+		var size int64
+		if size, err = store.CensusSize(electionId); err != nil {
+			return
+		}
+		census += size
+	}
+	// the json turnout is a fraction, null without census
+	var turnout interface{}
+	turnoutText := "-"
+	if census > 0 {
+		turnout = float64(count) / float64(census)
+		turnoutText = fmt.Sprintf("%.2f%%", 100*float64(count)/float64(census))
+	}
+
+	return a.output([]string{"count", "census", "turnout"}, [][]string{{strconv.FormatInt(count, 10), strconv.FormatInt(census, 10), turnoutText}},
+		map[string]interface{}{"count": count, "census": census, "turnout": turnout})
+}
+
+// filters is a repeatable flag
+type filters []string
+
+func (f *filters) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *filters) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// likePattern returns the regexp of a sql like pattern, where % matches any
+// text and _ any character
+func likePattern(like string) *regexp.Regexp {
+	var pattern strings.Builder
+	pattern.WriteString("(?s)^")
+	for _, r := range like {
+		switch r {
+		case '%':
+			pattern.WriteString(".*")
+		case '_':
+			pattern.WriteString(".")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	pattern.WriteString("$")
+	return regexp.MustCompile(pattern.String())
+}
+
+// parseFilter parses key==value (equality) and key~value (sql like) filters
+// into a vote predicate
+func parseFilter(filter string) (match func(v *ballotbox.Vote) bool, err error) {
+	var key, value string
+	like := false
+	if parts := strings.SplitN(filter, "~", 2); len(parts) == 2 {
+		key, value, like = parts[0], parts[1], true
+	} else if parts := strings.SplitN(filter, "==", 2); len(parts) == 2 {
+		key, value = parts[0], parts[1]
+	} else {
+		return nil, errors.New("invalid filter " + filter)
+	}
+	column, ok := voteColumns[key]
+	if !ok {
+		return nil, errors.New("unknown column " + key)
+	}
+	if like {
+		pattern := likePattern(value)
+		return func(v *ballotbox.Vote) bool { return pattern.MatchString(column(v)) }, nil
+	}
+	return func(v *ballotbox.Vote) bool { return column(v) == value }, nil
+}
+
+func listVotes(a *admin, args []string) (err error) {
+	flags := flag.NewFlagSet("list_votes", flag.ExitOnError)
+	var voteFilters filters
+	flags.Var(&voteFilters, "f", "key==value filter for the query (use ~ for like), can be repeated")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("expected one election id")
+	}
+
+	var matches []func(v *ballotbox.Vote) bool
+	for _, filter := range voteFilters {
+		match, err := parseFilter(filter)
+		if err != nil {
+			return err
+		}
+		matches = append(matches, match)
+	}
+
+	store, err := a.store()
+	if err != nil {
+		return
+	}
+	var votes []*ballotbox.Vote
+	err = store.IterateVotes(flags.Arg(0), 0, 0, true, func(v *ballotbox.Vote) error {
+		for _, match := range matches {
+			if !match(v) {
+				return nil
+			}
+		}
+		votes = append(votes, v)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	rows := [][]string{}
+	data := []map[string]interface{}{}
+	for _, v := range votes {
+		rows = append(rows, []string{strconv.FormatInt(v.Id, 10), truncate(v.Vote), truncate(v.VoteHash), v.ElectionId,
+			truncate(v.VoterId), v.Ip, truncate(v.Created.Format(voteTimeFormat)), truncate(v.Modified.Format(voteTimeFormat)), strconv.FormatInt(v.WriteCount, 10)})
+		data = append(data, map[string]interface{}{
+			"id":          v.Id,
+			"vote":        v.Vote,
+			"vote_hash":   v.VoteHash,
+			"election_id": v.ElectionId,
+			"voter_id":    v.VoterId,
+			"ip":          v.Ip,
+			"created":     v.Created,
+			"modified":    v.Modified,
+			"write_count": v.WriteCount,
+		})
+	}
+	return a.output([]string{"id", "vote", "vote_hash", "election_id", "voter_id", "ip", "created", "modified", "writes"}, rows, data)
+}
+
+func printVoterIds(a *admin, args []string) (err error) {
+	flags := flag.NewFlagSet("print_voterids", flag.ExitOnError)
+	voterIdsPath := flags.String("voter-ids-path", "", "path to a file with valid voter ids for filtering")
+	flags.Parse(args)
+	electionIds := flags.Args()
+	if len(electionIds) == 0 {
+		return errors.New("no election ids")
+	}
+
+	var voterIds map[string]bool
+	if *voterIdsPath != "" {
+		if voterIds, err = readVoterIds(*voterIdsPath); err != nil {
+			return
+		}
+	}
+
+	store, err := a.store()
+	if err != nil {
+		return
+	}
+	ids := []string{}
+	err = distinctVotes(store, electionIds, false, func(v *ballotbox.Vote) error {
+		if voterIds != nil && !voterIds[v.VoterId] {
+			return nil
+		}
+		// streamed unless the output is json
+		if a.json {
+			ids = append(ids, v.VoterId)
+		} else {
+			fmt.Fprintln(a.out, v.VoterId)
+		}
+		return nil
+	})
+	if err != nil || !a.json {
+		return
+	}
+	return a.output(nil, nil, ids)
+}
+
+func reloadConfig(a *admin, args []string) (err error) {
+	flags := flag.NewFlagSet("reload_config", flag.ExitOnError)
+	port := flags.Int("ballotbox-port", 3000, "the port that the ballotbox is listening on")
+	principal := flags.String("principal", "", "the admin making the call, by default the first of the config Admins")
+	flags.Parse(args)
+	if *principal == "" && len(a.cfg.Admins) > 0 {
+		*principal = a.cfg.Admins[0]
+	}
+
+	url := fmt.Sprintf("http://localhost:%d/api/v1/ballotbox/reload-config", *port)
+	r, err := http.NewRequest("POST", url, strings.NewReader("{}"))
+	if err != nil {
+		return
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if *principal != "" {
+		r.Header.Set("Authorization", ballotbox.AdminAuthHeader(ballotbox.PermGlobalAdmin, *principal, a.cfg.SharedSecret))
+	} else {
+		// legacy token, without principal
+		r.Header.Set("Authorization", middleware.AuthHeader("admin", a.cfg.SharedSecret))
+	}
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(r)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	// elections refused by the ballotbox, by id
+	var result struct {
+		Errors map[string][]string `json:"errors"`
+	}
+	json.Unmarshal(body, &result)
+
+	electionIds := []string{}
+	for electionId := range result.Errors {
+		electionIds = append(electionIds, electionId)
+	}
+	sort.Strings(electionIds)
+	rows := [][]string{}
+	for _, electionId := range electionIds {
+		for _, diagnostic := range result.Errors[electionId] {
+			rows = append(rows, []string{strconv.Itoa(resp.StatusCode), electionId, diagnostic})
+		}
+	}
+	if len(rows) == 0 {
+		rows = append(rows, []string{strconv.Itoa(resp.StatusCode), "", ""})
+	}
+	if err = a.output([]string{"status", "election_id", "error"}, rows, map[string]interface{}{"status": resp.StatusCode, "errors": result.Errors}); err != nil {
+		return
+	}
+	// a rejected reload fails the command
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("reload-config failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return
+}
+
+func audit(a *admin, args []string) (err error) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	workers := flags.Int("workers", runtime.NumCPU(), "number of ballots validated in parallel")
+	checkResidues := flags.Bool("check-residues", true, "check that alpha and beta are quadratic residues")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("expected one election id")
+	}
+	electionId := flags.Arg(0)
+
+	store, err := a.store()
+	if err != nil {
+		return
+	}
+	total, err := store.CountVotes(electionId)
+	if err != nil {
+		return
+	}
+
+	report, err := ballotbox.AuditElection(store, a.cfg.ElectionDir, electionId, *checkResidues, *workers, func(checked int64) {
+		fmt.Fprintf(os.Stderr, "\r> checked %d/%d votes", checked, total)
+	})
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\r> checked %d/%d votes, %d invalid\n", report.Checked, total, len(report.Invalid))
+
+	// pubkeys failing verification are reported before the ballots
+	rows := [][]string{}
+	for _, diagnostic := range report.PkErrors {
+		fmt.Fprintf(os.Stderr, "> invalid pubkeys: %s\n", diagnostic)
+		rows = append(rows, []string{"", "", "", "Invalid pubkeys: " + diagnostic})
+	}
+	for _, b := range report.Invalid {
+		rows = append(rows, []string{strconv.FormatInt(b.Id, 10), b.VoterId, truncate(b.VoteHash), b.Reason})
+	}
+	return a.output([]string{"id", "voter_id", "vote_hash", "reason"}, rows, report)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/agoravoting/agora-api/ballotbox"
+)
+
+func TestParseFilter(t *testing.T) {
+	v := &ballotbox.Vote{Id: 7, VoterId: "1", Ip: "10.0.3.4", Created: time.Date(2015, 2, 2, 10, 0, 0, 0, time.UTC)}
+	for filter, expected := range map[string]bool{
+		"voter_id==1":       true,
+		"voter_id==11":      false,
+		"id==7":             true,
+		"ip~10.0.%":         true,
+		"ip~10.0._":         false,
+		"ip~10._.3.4":       true,
+		"ip~10.1.%":         false,
+		"ip~10%0.3.4":       true,
+		"created~2015-02-%": true,
+	} {
+		match, err := parseFilter(filter)
+		if err != nil || match(v) != expected {
+			t.Fatalf("Unexpected match of %s %v", filter, err)
+		}
+	}
+	// regexp characters are not special in like patterns
+	if match, _ := parseFilter("ip~10.0.3.4"); match(&ballotbox.Vote{Ip: "10a0b3c4"}) {
+		t.Fatalf("Like pattern matched as a regexp")
+	}
+	if _, err := parseFilter("1=1; DROP TABLE votes;--==1"); err == nil {
+		t.Fatalf("Filter on unknown column accepted")
+	}
+	if _, err := parseFilter("voter_id"); err == nil {
+		t.Fatalf("Filter without operator accepted")
+	}
+}
+
+func TestPrintTable(t *testing.T) {
+	var out bytes.Buffer
+	printTable(&out, []string{"id", "pk"}, [][]string{{"1020", "true"}})
+	expected := "+------+------+\n| id   | pk   |\n+------+------+\n| 1020 | true |\n+------+------+\n"
+	if out.String() != expected {
+		t.Fatalf("Unexpected table\n%s", out.String())
+	}
+	if truncate("0123456789012345678901") != "01234567890123456789.." {
+		t.Fatalf("Unexpected truncation")
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha512"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/agoravoting/agora-api/ballotbox"
+)
+
+// readVoterIds reads a file with one voter id per line
+func readVoterIds(filePath string) (ids map[string]bool, err error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return
+	}
+	ids = make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if id := strings.TrimSpace(line); id != "" {
+			ids[id] = true
+		}
+	}
+	return
+}
+
+// distinctVotes calls fn with the counted vote of each voter of the given
+// elections, ordered by voter id like the distinct on (voter_id) query of
+// the admin script. As there, a voter with votes in several of them only
+// counts in the one with the greatest id. The vote text is only read if
+// withVote is set
+func distinctVotes(store ballotbox.VoteStore, electionIds []string, withVote bool, fn func(v *ballotbox.Vote) error) error {
+	sorted := append([]string{}, electionIds...)
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+	votes := make(map[string]*ballotbox.Vote)
+	for _, electionId := range sorted {
+		err := store.IterateVotes(electionId, 0, 0, withVote, func(v *ballotbox.Vote) error {
+			if _, seen := votes[v.VoterId]; !seen {
+				votes[v.VoterId] = v
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	voterIds := make([]string, 0, len(votes))
+	for voterId := range votes {
+		voterIds = append(voterIds, voterId)
+	}
+	sort.Strings(voterIds)
+	for _, voterId := range voterIds {
+		if err := fn(votes[voterId]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ctextsFile is the ciphertexts dump of an election, split in partials
+// ctexts_<id>, ctexts_<id>.1, .. when there is a maximum count
+type ctextsFile struct {
+	electionId string
+	basePath   string
+	total      int
+	filtered   int
+	partial    int
+
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	hash   hash.Hash
+}
+
+func (c *ctextsFile) open() (err error) {
+	c.path = c.basePath
+	if c.partial > 0 {
+		c.path = fmt.Sprintf("%s.%d", c.basePath, c.partial)
+	}
+	if c.file, err = os.Create(c.path); err != nil {
+		return
+	}
+	c.hash = sha512.New()
+	c.writer = bufio.NewWriter(io.MultiWriter(c.file, c.hash))
+	return
+}
+
+// close closes the current part and writes its checksum next to it, in
+// the format used by sha512sum
+func (c *ctextsFile) close() (err error) {
+	if err = c.writer.Flush(); err != nil {
+		c.file.Close()
+		return
+	}
+	if err = c.file.Close(); err != nil {
+		return
+	}
+	checksum := fmt.Sprintf("%x  %s\n", c.hash.Sum(nil), filepath.Base(c.path))
+	return ioutil.WriteFile(c.path+".sha512", []byte(checksum), 0644)
+}
+
+// ctextsDumper writes votes in the format expected by eo, one per line
+type ctextsDumper struct {
+	maxCount int
+	// voter ids to filter with, nil to dump every vote
+	voterIds map[string]bool
+	// whether voterIds are the voters to exclude
+	invalid bool
+	files   map[string]*ctextsFile
+	out     io.Writer
+}
+
+func newCtextsDumper(electionDir string, electionIds []string, maxCount int, voterIds map[string]bool, invalid bool, out io.Writer) (d *ctextsDumper, err error) {
+	d = &ctextsDumper{
+		maxCount: maxCount,
+		voterIds: voterIds,
+		invalid:  invalid,
+		files:    make(map[string]*ctextsFile),
+		out:      out,
+	}
+	for _, electionId := range electionIds {
+		c := &ctextsFile{
+			electionId: electionId,
+			basePath:   path.Join(electionDir, electionId, "ctexts_"+electionId),
+		}
+		if err = c.open(); err != nil {
+			return
+		}
+		d.files[electionId] = c
+	}
+	return
+}
+
+func (d *ctextsDumper) write(v *ballotbox.Vote) (err error) {
+	c, ok := d.files[v.ElectionId]
+	if !ok {
+		return errors.New("Unexpected election id " + v.ElectionId)
+	}
+
+	if d.voterIds != nil && d.voterIds[v.VoterId] == d.invalid {
+		c.filtered++
+		return
+	}
+
+	if _, err = c.writer.WriteString(v.Vote + "\n"); err != nil {
+		return
+	}
+	c.total++
+	if d.maxCount != 0 && c.total%d.maxCount == 0 {
+		if err = c.close(); err != nil {
+			return
+		}
+		c.partial++
+		if err = c.open(); err != nil {
+			return
+		}
+		fmt.Fprintf(d.out, "creating partial for %s num %d\n", c.electionId, c.partial)
+	}
+	return
+}
+
+// close closes every file and prints the totals
+func (d *ctextsDumper) close() (err error) {
+	total := 0
+	filtered := 0
+	for electionId, c := range d.files {
+		total += c.total
+		filtered += c.filtered
+		fmt.Fprintf(d.out, "> dumped %d votes to %s (%d filtered)\n", c.total, electionId, c.filtered)
+		if cerr := c.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	fmt.Fprintf(d.out, "> dumped %d votes in total (%d filtered)\n", total, filtered)
+	return
+}
+
+// dumpVotesEo is the port of the admin script dump_votes_eo command
+func dumpVotesEo(a *admin, args []string) (err error) {
+	flags := flag.NewFlagSet("dump_votes_eo", flag.ExitOnError)
+	var maxCount int
+	flags.IntVar(&maxCount, "max-count", 0, "maximum number of votes in each dump part, 0 for no limit")
+	flags.IntVar(&maxCount, "m", 0, "shorthand for -max-count")
+	voterIdsPath := flags.String("voter-ids-path", "", "path to a file with valid voter ids for filtering")
+	invalid := flags.Bool("invalid", false, "the voter ids in voter-ids-path are the invalid ones")
+	flags.Parse(args)
+
+	electionIds := flags.Args()
+	if len(electionIds) == 0 {
+		return errors.New("no election ids")
+	}
+
+	var voterIds map[string]bool
+	if *voterIdsPath != "" {
+		if voterIds, err = readVoterIds(*voterIdsPath); err != nil {
+			return
+		}
+	}
+
+	store, err := a.store()
+	if err != nil {
+		return
+	}
+	dumper, err := newCtextsDumper(a.cfg.ElectionDir, electionIds, maxCount, voterIds, *invalid, a.out)
+	if err != nil {
+		return
+	}
+	err = distinctVotes(store, electionIds, true, dumper.write)
+	if cerr := dumper.close(); err == nil {
+		err = cerr
+	}
+	return
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/agoravoting/agora-api/ballotbox"
+)
+
+func TestCtextsDumper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ballotbox-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(path.Join(dir, "1020"), 0755)
+
+	voterIds := map[string]bool{"1": true, "2": true, "3": true, "4": true, "5": true}
+	dumper, err := newCtextsDumper(dir, []string{"1020"}, 2, voterIds, false, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 6; i++ {
+		v := &ballotbox.Vote{Vote: fmt.Sprintf("vote%d", i), VoterId: fmt.Sprintf("%d", i), ElectionId: "1020"}
+		if err = dumper.write(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = dumper.write(&ballotbox.Vote{Vote: "vote", VoterId: "1", ElectionId: "1"}); err == nil {
+		t.Fatalf("Vote for an election not being dumped accepted")
+	}
+	if c := dumper.files["1020"]; c.total != 5 || c.filtered != 1 {
+		t.Fatalf("Unexpected totals %d, %d", c.total, c.filtered)
+	}
+	if err = dumper.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"ctexts_1020":   "vote1\nvote2\n",
+		"ctexts_1020.1": "vote3\nvote4\n",
+		"ctexts_1020.2": "vote5\n",
+	}
+	for name, content := range expected {
+		data, err := ioutil.ReadFile(path.Join(dir, "1020", name))
+		if err != nil || string(data) != content {
+			t.Fatalf("Unexpected content in %s: %q %v", name, data, err)
+		}
+		checksum, err := ioutil.ReadFile(path.Join(dir, "1020", name+".sha512"))
+		if err != nil || string(checksum) != fmt.Sprintf("%x  %s\n", sha512.Sum512(data), name) {
+			t.Fatalf("Unexpected checksum for %s: %q %v", name, checksum, err)
+		}
+	}
+}
+
+func TestDistinctVotes(t *testing.T) {
+	store, err := ballotbox.OpenVoteStore("memory", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cast := range [][2]string{{"1020", "1"}, {"1020", "2"}, {"1021", "2"}, {"1021", "3"}} {
+		vote := cast[0] + "/" + cast[1]
+		v := &ballotbox.Vote{Vote: vote, VoteHash: ballotbox.HashSha256(vote), ElectionId: cast[0], VoterId: cast[1]}
+		if _, err = store.CastVote(v, "127.0.0.1", ballotbox.CastLimits{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// voter 2 counts in 1021, in voter id order
+	votes := []string{}
+	err = distinctVotes(store, []string{"1020", "1021"}, true, func(v *ballotbox.Vote) error {
+		votes = append(votes, v.Vote)
+		return nil
+	})
+	if err != nil || fmt.Sprint(votes) != "[1020/1 1021/2 1021/3]" {
+		t.Fatalf("Unexpected distinct votes %v %v", votes, err)
+	}
+}
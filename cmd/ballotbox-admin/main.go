@@ -0,0 +1,144 @@
+// ballotbox-admin provides administration commands for the ballotbox that
+// work directly on the vote store and the elections directory
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/agoravoting/agora-api/ballotbox"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+// the subset of the server config.json used by the admin commands
+type backendConfig struct {
+	DbConnectString string   `json:"DbConnectString"`
+	SharedSecret    string   `json:"SharedSecret"`
+	ElectionDir     string   `json:"electionDir"`
+	Admins          []string `json:"Admins"`
+	VoteStore       string   `json:"voteStore"`
+	VoteStorePath   string   `json:"voteStorePath"`
+	// nil means true, see the ballotbox implicitOpen option
+	ImplicitOpen *bool `json:"implicitOpen"`
+}
+
+// implicitOpen returns the ballotbox implicitOpen option, true by default
+func (cfg backendConfig) implicitOpen() bool {
+	return cfg.ImplicitOpen == nil || *cfg.ImplicitOpen
+}
+
+type admin struct {
+	cfg   backendConfig
+	db    *sqlx.DB
+	votes ballotbox.VoteStore
+	// print json instead of tables
+	json bool
+	out  io.Writer
+}
+
+type command struct {
+	usage string
+	run   func(a *admin, args []string) error
+}
+
+var commands = map[string]*command{
+	"list_elections": {"list_elections: list elections (under the elections directory)", listElections},
+	"count_votes":    {"count_votes <election_id> [<election_id2> [..]]: count votes", countVotes},
+	"list_votes":     {"list_votes [-f key==value] [-f key~like] <election_id>: list votes", listVotes},
+	"dump_votes_eo":  {"dump_votes_eo [flags] <election_id> [<election_id2> [..]]: dumps votes ready for eo", dumpVotesEo},
+	"print_voterids": {"print_voterids [-voter-ids-path path] <election_id> [<election_id2> [..]]: prints voter ids", printVoterIds},
+	"audit":          {"audit [-workers n] [-check-residues=false] <election_id>: re-validates the stored ballots", audit},
+	"reload_config":  {"reload_config [-ballotbox-port 3000] [-principal admin]: makes the running ballotbox reload the election configs", reloadConfig},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: ballotbox-admin [-config config.json] <command> [args]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func loadConfig(path string) (cfg backendConfig, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &cfg)
+	return
+}
+
+// connect opens the database connection on first use, commands that only
+// look at the elections directory don't need it
+func (a *admin) connect() (db *sqlx.DB, err error) {
+	if a.db == nil {
+		a.db, err = sqlx.Connect("postgres", a.cfg.DbConnectString)
+	}
+	return a.db, err
+}
+
+// store opens the vote store configured like the ballotbox one on first use,
+// connecting to the database only for the postgres store
+func (a *admin) store() (store ballotbox.VoteStore, err error) {
+	if a.votes != nil {
+		return a.votes, nil
+	}
+	var db *sqlx.DB
+	if a.cfg.VoteStore == "" || a.cfg.VoteStore == "postgres" {
+		if db, err = a.connect(); err != nil {
+			return
+		}
+	}
+	a.votes, err = ballotbox.OpenVoteStore(a.cfg.VoteStore, a.cfg.VoteStorePath, db)
+	return a.votes, err
+}
+
+func main() {
+	var conf = flag.String("config", "config.json", "path to the ballotbox config file")
+	var electionDir = flag.String("election-dir", "", "elections directory, defaults to electionDir in the config file")
+	var jsonOutput = flag.Bool("json", false, "print json instead of tables")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(1)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %s\n\n", flag.Arg(0))
+		usage()
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig(*conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading config %s: %v\n", *conf, err)
+		os.Exit(1)
+	}
+	if *electionDir != "" {
+		cfg.ElectionDir = *electionDir
+	}
+
+	a := &admin{cfg: cfg, json: *jsonOutput, out: os.Stdout}
+	if err = cmd.run(a, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+	if a.db != nil {
+		a.db.Close()
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// printTable writes rows in the same layout as the python prettytable used
+// by the admin script
+func printTable(out io.Writer, headers []string, rows [][]string) {
+	widths := make([]int, len(headers))
+	for i, header := range headers {
+		widths[i] = utf8.RuneCountInString(header)
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	separator := "+"
+	for _, width := range widths {
+		separator += strings.Repeat("-", width+2) + "+"
+	}
+	printRow := func(row []string) {
+		line := "|"
+		for i, cell := range row {
+			line += " " + cell + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)) + " |"
+		}
+		fmt.Fprintln(out, line)
+	}
+
+	fmt.Fprintln(out, separator)
+	printRow(headers)
+	fmt.Fprintln(out, separator)
+	for _, row := range rows {
+		printRow(row)
+	}
+	fmt.Fprintln(out, separator)
+}
+
+// truncate shortens long values in tables, as the admin script did
+func truncate(value string) string {
+	if utf8.RuneCountInString(value) > 20 {
+		return string([]rune(value)[:20]) + ".."
+	}
+	return value
+}
+
+// output prints data as indented json if requested, or else as a table
+func (a *admin) output(headers []string, rows [][]string, data interface{}) error {
+	if a.json {
+		b, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(a.out, string(b))
+		return nil
+	}
+	printTable(a.out, headers, rows)
+	return nil
+}
@@ -0,0 +1,12 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE elections (
+  id varchar(1024) PRIMARY KEY,
+  state varchar(32) NOT NULL,
+  created timestamp DEFAULT current_timestamp,
+  modified timestamp DEFAULT current_timestamp
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+DROP TABLE elections;
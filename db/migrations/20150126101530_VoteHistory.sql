@@ -0,0 +1,30 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE vote_history (
+  id serial PRIMARY KEY,
+  vote_id int NOT NULL REFERENCES votes(id),
+  vote text NOT NULL,
+  vote_hash varchar(1024) NOT NULL,
+  election_id varchar(1024) NOT NULL,
+  voter_id varchar(1024) NOT NULL,
+  ip varchar(64) NOT NULL,
+  created timestamp DEFAULT current_timestamp,
+  write_count int NOT NULL
+);
+CREATE INDEX vote_history_election_id_voter_id ON vote_history(election_id, voter_id);
+
+-- earlier casts were overwritten, only the current ones can be kept
+INSERT INTO vote_history(vote_id, vote, vote_hash, election_id, voter_id, ip, created, write_count) SELECT id, vote, vote_hash, election_id, voter_id, ip, modified, write_count FROM votes;
+
+-- same as the previous set_vote, but every accepted cast is also appended to vote_history
+-- function on one line as goose does not seem to work otherwise
+CREATE OR REPLACE FUNCTION set_vote(v TEXT, vh TEXT, eid TEXT, vid TEXT, theip TEXT, max_writes INT)
+RETURNS BOOL AS $$ DECLARE cast_id INT; BEGIN BEGIN INSERT INTO votes(vote, vote_hash, election_id, voter_id, ip) VALUES (v, vh, eid, vid, theip) RETURNING id INTO cast_id; EXCEPTION WHEN unique_violation THEN UPDATE votes SET vote = v, vote_hash = vh, ip = theip, modified = current_timestamp, write_count = write_count + 1 WHERE voter_id = vid and election_id = eid and write_count < max_writes RETURNING id INTO cast_id; IF NOT FOUND THEN RETURN FALSE; END IF; END; INSERT INTO vote_history(vote_id, vote, vote_hash, election_id, voter_id, ip, write_count) SELECT id, vote, vote_hash, election_id, voter_id, ip, write_count FROM votes WHERE id = cast_id; RETURN TRUE; END; $$
+LANGUAGE plpgsql;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+CREATE OR REPLACE FUNCTION set_vote(v TEXT, vh TEXT, eid TEXT, vid TEXT, theip TEXT, max_writes INT)
+RETURNS BOOL AS $$ BEGIN BEGIN INSERT INTO votes(vote, vote_hash, election_id, voter_id, ip) VALUES (v, vh, eid, vid, theip); RETURN FOUND; EXCEPTION WHEN unique_violation THEN UPDATE votes SET vote = v, vote_hash = vh, ip = theip, modified = current_timestamp, write_count = write_count + 1 WHERE voter_id = vid and election_id = eid and write_count < max_writes; RETURN FOUND; END; END; $$
+LANGUAGE plpgsql;
+DROP TABLE vote_history;
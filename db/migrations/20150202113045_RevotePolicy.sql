@@ -0,0 +1,17 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+ALTER TABLE vote_history ADD COLUMN counted boolean NOT NULL DEFAULT true;
+
+-- replaces set_vote, applying the re-vote policy of the election. max_writes 0 means no limit, cooldown is in seconds
+-- and keep_first only records re-casts in vote_history. The result is stored, hash-taken, max-writes, cooldown or
+-- recorded, and when stored cast_id and cast_write_count are those of the vote, read in the same transaction
+-- a vote hash taken concurrently by another voter is reported as hash-taken, both on insert and on update
+-- function on one line as goose does not seem to work otherwise
+CREATE FUNCTION cast_vote(v TEXT, vh TEXT, eid TEXT, vid TEXT, theip TEXT, max_writes INT, cooldown INT, keep_first BOOL, OUT result TEXT, OUT cast_id INT, OUT cast_write_count INT)
+AS $$ DECLARE cur votes%ROWTYPE; hash_vote votes%ROWTYPE; BEGIN LOOP SELECT * INTO hash_vote FROM votes WHERE vote_hash = vh; IF FOUND AND (hash_vote.voter_id <> vid OR hash_vote.election_id <> eid) THEN result := 'hash-taken'; RETURN; END IF; SELECT * INTO cur FROM votes WHERE voter_id = vid AND election_id = eid FOR UPDATE; IF NOT FOUND THEN BEGIN INSERT INTO votes(vote, vote_hash, election_id, voter_id, ip) VALUES (v, vh, eid, vid, theip) RETURNING * INTO cur; EXIT; EXCEPTION WHEN unique_violation THEN END; ELSE IF max_writes > 0 AND cur.write_count >= max_writes THEN result := 'max-writes'; RETURN; END IF; IF cur.modified > current_timestamp - cooldown * interval '1 second' THEN result := 'cooldown'; RETURN; END IF; IF keep_first THEN UPDATE votes SET modified = current_timestamp, write_count = write_count + 1 WHERE id = cur.id; INSERT INTO vote_history(vote_id, vote, vote_hash, election_id, voter_id, ip, write_count, counted) VALUES (cur.id, v, vh, eid, vid, theip, cur.write_count + 1, false); result := 'recorded'; RETURN; END IF; BEGIN UPDATE votes SET vote = v, vote_hash = vh, ip = theip, modified = current_timestamp, write_count = write_count + 1 WHERE id = cur.id RETURNING * INTO cur; EXCEPTION WHEN unique_violation THEN result := 'hash-taken'; RETURN; END; EXIT; END IF; END LOOP; INSERT INTO vote_history(vote_id, vote, vote_hash, election_id, voter_id, ip, write_count) VALUES (cur.id, cur.vote, cur.vote_hash, eid, vid, theip, cur.write_count); result := 'stored'; cast_id := cur.id; cast_write_count := cur.write_count; END; $$
+LANGUAGE plpgsql;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+DROP FUNCTION cast_vote(v TEXT, vh TEXT, eid TEXT, vid TEXT, theip TEXT, max_writes INT, cooldown INT, keep_first BOOL);
+ALTER TABLE vote_history DROP COLUMN counted;
@@ -0,0 +1,12 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE census (
+  election_id varchar(1024) NOT NULL,
+  voter_id varchar(1024) NOT NULL,
+  created timestamp DEFAULT current_timestamp,
+  PRIMARY KEY (election_id, voter_id)
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+DROP TABLE census;
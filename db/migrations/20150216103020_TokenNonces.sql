@@ -0,0 +1,20 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE token_nonces (
+  election_id varchar(1024) NOT NULL,
+  nonce varchar(128) NOT NULL,
+  expires timestamp with time zone,
+  PRIMARY KEY (election_id, nonce)
+);
+CREATE INDEX token_nonces_expires ON token_nonces(expires);
+
+-- records the nonce of a one-time voter token, dropping the expired ones first. Returns false if it was already used
+-- function on one line as goose does not seem to work otherwise
+CREATE FUNCTION use_nonce(eid TEXT, n TEXT, exp TIMESTAMP WITH TIME ZONE)
+RETURNS BOOLEAN AS $$ BEGIN DELETE FROM token_nonces WHERE expires < current_timestamp; INSERT INTO token_nonces(election_id, nonce, expires) VALUES (eid, n, exp); RETURN true; EXCEPTION WHEN unique_violation THEN RETURN false; END; $$
+LANGUAGE plpgsql;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+DROP FUNCTION use_nonce(eid TEXT, n TEXT, exp TIMESTAMP WITH TIME ZONE);
+DROP TABLE token_nonces;
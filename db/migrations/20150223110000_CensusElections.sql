@@ -0,0 +1,12 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+-- the elections that have a census, even if every voter was removed from it
+CREATE TABLE census_elections (
+  election_id varchar(1024) PRIMARY KEY,
+  created timestamp DEFAULT current_timestamp
+);
+INSERT INTO census_elections(election_id) SELECT DISTINCT election_id FROM census;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+DROP TABLE census_elections;
@@ -1,19 +1,124 @@
-// generates
+// generates auth headers for testing, HMAC ones with -secret, or signed voter
+// tokens with -key, see ballotbox/token.go. -once adds a nonce, for elections
+// with one_time_tokens, and -principal makes admin tokens. -genkey creates a
+// key pair, the private key at -key and the public one at <key>.pub, to be
+// copied to the authkeys_<election-id> file
 
 package main
 
 import (
+  "github.com/agoravoting/agora-api/ballotbox"
   "github.com/agoravoting/agora-http-go/middleware"
+  "crypto"
+  "crypto/ed25519"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/x509"
+  "encoding/pem"
   "fmt"
   "flag"
+  "io/ioutil"
+  "log"
+  "time"
 )
 
+// genKey writes a new private key at keyPath and its public key at keyPath.pub
+func genKey(keyType string, keyPath string) {
+  var (
+    key crypto.Signer
+    err error
+  )
+  switch keyType {
+  case "ed25519":
+    _, key, err = ed25519.GenerateKey(rand.Reader)
+  case "rsa":
+    key, err = rsa.GenerateKey(rand.Reader, 2048)
+  default:
+    log.Fatalf("Unknown key type %s", keyType)
+  }
+  if err != nil {
+    log.Fatal(err)
+  }
+  private, err := x509.MarshalPKCS8PrivateKey(key)
+  if err != nil {
+    log.Fatal(err)
+  }
+  public, err := x509.MarshalPKIXPublicKey(key.Public())
+  if err != nil {
+    log.Fatal(err)
+  }
+  if err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private}), 0600); err != nil {
+    log.Fatal(err)
+  }
+  if err = ioutil.WriteFile(keyPath+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644); err != nil {
+    log.Fatal(err)
+  }
+  fmt.Printf("keys written to '%s' and '%s.pub'\n", keyPath, keyPath)
+}
+
+// readKey reads a PEM PKCS8 private key
+func readKey(keyPath string) crypto.Signer {
+  data, err := ioutil.ReadFile(keyPath)
+  if err != nil {
+    log.Fatal(err)
+  }
+  block, _ := pem.Decode(data)
+  if block == nil {
+    log.Fatalf("No PEM data in %s", keyPath)
+  }
+  key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+  if err != nil {
+    log.Fatal(err)
+  }
+  signer, ok := key.(crypto.Signer)
+  if !ok {
+    log.Fatalf("Unsupported key in %s", keyPath)
+  }
+  return signer
+}
+
 func main() {
   var secret = flag.String("secret", "elpastelestaenelhorno", "secret")
   var msg = flag.String("msg", "whatever", "message to sign")
+  var keyPath = flag.String("key", "", "private key to sign a voter token with instead of the secret")
+  var genkey = flag.String("genkey", "", "generate an ed25519 or rsa key pair at -key")
+  var expire = flag.Int("expire", 3600, "validity of signed tokens in seconds")
+  var once = flag.Bool("once", false, "generate a one-time token, with a nonce")
+  var principal = flag.String("principal", "", "the admin named by an admin token, -msg being the permission")
   flag.Parse()
 
-  fmt.Printf("secret used: '%s'\n", *secret)
+  if *genkey != "" {
+    if *keyPath == "" {
+      log.Fatal("-genkey needs -key")
+    }
+    genKey(*genkey, *keyPath)
+    return
+  }
+
   fmt.Printf("msg used: '%s'\n", *msg)
+  if *keyPath != "" {
+    fmt.Printf("key used: '%s'\n", *keyPath)
+    nonce := ""
+    if *once {
+      nonce = ballotbox.NewNonce()
+    }
+    token, err := ballotbox.SignVoterToken(readKey(*keyPath), *msg, time.Now().Add(time.Duration(*expire)*time.Second), nonce)
+    if err != nil {
+      log.Fatal(err)
+    }
+    fmt.Println("Bearer " + token)
+    return
+  }
+
+  fmt.Printf("secret used: '%s'\n", *secret)
+  if *once {
+    fmt.Println(ballotbox.OneTimeAuthHeader(*msg, *secret))
+    return
+  }
+  if *principal != "" {
+    fmt.Printf("principal used: '%s'\n", *principal)
+    fmt.Println(ballotbox.AdminAuthHeader(*msg, *principal, *secret))
+    return
+  }
   fmt.Println(middleware.AuthHeader(*msg, *secret))
-}
\ No newline at end of file
+}